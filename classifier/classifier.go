@@ -0,0 +1,457 @@
+// Package classifier decides where SQL statements received by the proxies
+// can run, by lexing them according to the SQL dialect of the server.
+package classifier
+
+import (
+	"strings"
+)
+
+// Dialect selects the lexical rules of a server.
+type Dialect int
+
+const (
+	MySQL Dialect = iota
+	PostgreSQL
+)
+
+// Kind is the effect of a statement on the session.
+type Kind int
+
+const (
+	// Read statements only read data and can run on a secondary.
+	Read Kind = iota
+	// Write statements modify data or lock rows.
+	Write
+	// Transaction statements begin or end transactions.
+	Transaction
+	// Session statements read or change state bound to the session, such
+	// as settings, variables, prepared statements or cursors.
+	Session
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Transaction:
+		return "transaction control"
+	case Session:
+		return "session state"
+	}
+	return "unknown"
+}
+
+// Verdict is the classification of a query, which may hold several
+// statements.
+type Verdict struct {
+	Kind Kind
+	// Reason tells what made the query fall into Kind.
+	Reason string
+	// Statements is the number of statements in the query.
+	Statements int
+	// ReadOnly is set for a Transaction statement starting a read-only
+	// transaction, or making the next or current transaction read-only
+	// with SET TRANSACTION.
+	ReadOnly bool
+	// State is the session-scoped state the statements create or release,
+	// in order.
+	State []StateChange
+	// Settings are the session variables the statements set, in order.
+	Settings []Setting
+	// Database is the database a MySQL USE statement selects, as written.
+	Database string
+}
+
+func (v Verdict) String() string {
+	return v.Kind.String() + " (" + v.Reason + ")"
+}
+
+// Classifier classifies the statements of one dialect.
+type Classifier struct {
+	dialect Dialect
+	// functions holds the lower case names of the functions that make a
+	// query a write, schema qualified or not.
+	functions map[string]bool
+}
+
+// New returns a Classifier for dialect. Calls to the built-in functions of
+// the dialect with side effects, and to the given functions, make a query
+// a write.
+func New(dialect Dialect, functions []string) *Classifier {
+	c := &Classifier{dialect: dialect, functions: make(map[string]bool)}
+	builtin := mysqlFunctions
+	if dialect == PostgreSQL {
+		builtin = postgresFunctions
+	}
+	for _, name := range builtin {
+		c.functions[name] = true
+	}
+	for _, name := range functions {
+		c.functions[strings.ToLower(name)] = true
+	}
+	return c
+}
+
+// Classify returns the verdict for query. A query holding several
+// statements is read-only only if all of them are, otherwise the verdict
+// of the first statement that is not applies.
+func (c *Classifier) Classify(query string) Verdict {
+	var verdict *Verdict
+	var state []StateChange
+	var settings []Setting
+	var database string
+	statements := 0
+	for _, stmt := range splitStatements(lex(c.dialect, query)) {
+		statements++
+		v := c.statement(stmt)
+		if verdict == nil || verdict.Kind == Read && v.Kind != Read {
+			verdict = &v
+		}
+		state = append(state, c.state(stmt)...)
+		settings = append(settings, c.settings(query, stmt)...)
+		if name := c.database(query, stmt); name != "" {
+			database = name
+		}
+	}
+	if verdict == nil {
+		return Verdict{Kind: Write, Reason: "empty query"}
+	}
+	verdict.Statements = statements
+	verdict.State = state
+	verdict.Settings = settings
+	verdict.Database = database
+	return *verdict
+}
+
+// splitStatements drops comments and splits tokens at semicolons.
+func splitStatements(tokens []token) [][]token {
+	var stmts [][]token
+	var stmt []token
+	for _, t := range tokens {
+		switch {
+		case t.kind == tokComment:
+		case t.is(tokPunct, ";"):
+			if len(stmt) > 0 {
+				stmts = append(stmts, stmt)
+			}
+			stmt = nil
+		default:
+			stmt = append(stmt, t)
+		}
+	}
+	if len(stmt) > 0 {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// word returns the lower case word at index i, or "" if there is none.
+func word(stmt []token, i int) string {
+	if i >= 0 && i < len(stmt) && stmt[i].kind == tokWord {
+		return stmt[i].text
+	}
+	return ""
+}
+
+func (c *Classifier) statement(stmt []token) Verdict {
+	// a parenthesized query, as in (SELECT ...) UNION (SELECT ...)
+	start := 0
+	for start < len(stmt) && stmt[start].is(tokPunct, "(") {
+		start++
+	}
+	first := word(stmt, start)
+	second := word(stmt, start+1)
+	switch first {
+	case "select", "values", "table", "with":
+		return c.query(stmt[start:])
+	case "explain", "describe", "desc":
+		return c.explain(stmt[start:])
+	case "show":
+		return c.show(stmt[start:])
+	case "begin":
+		return Verdict{Kind: Transaction, Reason: "BEGIN", ReadOnly: readOnly(stmt[start:])}
+	case "commit", "rollback", "savepoint", "release", "end", "abort", "xa":
+		return Verdict{Kind: Transaction, Reason: strings.ToUpper(first)}
+	case "start":
+		if second == "transaction" {
+			return Verdict{Kind: Transaction, Reason: "START TRANSACTION", ReadOnly: readOnly(stmt[start:])}
+		}
+	case "set":
+		return c.set(stmt[start:])
+	case "prepare":
+		if second == "transaction" {
+			return Verdict{Kind: Transaction, Reason: "PREPARE TRANSACTION"}
+		}
+		return Verdict{Kind: Session, Reason: "PREPARE"}
+	case "execute", "deallocate", "reset", "discard", "use", "declare", "fetch", "move", "close",
+		"listen", "unlisten", "handler":
+		return Verdict{Kind: Session, Reason: strings.ToUpper(first)}
+	case "lock", "unlock":
+		if c.dialect == MySQL {
+			return Verdict{Kind: Session, Reason: strings.ToUpper(first) + " TABLES"}
+		}
+	case "":
+		return Verdict{Kind: Write, Reason: "unrecognized statement"}
+	}
+	return Verdict{Kind: Write, Reason: strings.ToUpper(first)}
+}
+
+// database returns the database stmt, read from query, selects if it is
+// a MySQL USE statement, or "".
+func (c *Classifier) database(query string, stmt []token) string {
+	if c.dialect != MySQL || word(stmt, 0) != "use" || len(stmt) != 2 {
+		return ""
+	}
+	switch t := stmt[1]; t.kind {
+	case tokWord:
+		return query[t.start:t.end]
+	case tokQuotedIdent:
+		return strings.ReplaceAll(t.text[1:len(t.text)-1], "``", "`")
+	}
+	return ""
+}
+
+// query classifies a SELECT, VALUES, TABLE or WITH statement, which reads
+// unless it locks rows, stores its result, or modifies data in a WITH
+// clause.
+func (c *Classifier) query(stmt []token) Verdict {
+	for i, t := range stmt {
+		switch t.kind {
+		case tokVariable:
+			if len(t.text) < 2 || t.text[1] != '@' {
+				return Verdict{Kind: Session, Reason: "user variable " + t.text}
+			}
+			continue
+		case tokWord:
+		default:
+			continue
+		}
+		if name := c.function(stmt, i); name != "" {
+			return Verdict{Kind: Write, Reason: "function " + name}
+		}
+		if i > 0 && stmt[i-1].is(tokPunct, ".") {
+			// a qualified name, as in t.update
+			continue
+		}
+		switch t.text {
+		case "for":
+			switch word(stmt, i+1) {
+			case "update", "share", "no", "key":
+				return Verdict{Kind: Write, Reason: "locking read FOR " + strings.ToUpper(word(stmt, i+1))}
+			}
+		case "lock":
+			if word(stmt, i+1) == "in" && word(stmt, i+2) == "share" {
+				return Verdict{Kind: Write, Reason: "locking read LOCK IN SHARE MODE"}
+			}
+		case "into":
+			return Verdict{Kind: Write, Reason: "SELECT INTO"}
+		case "insert", "update", "delete", "merge":
+			return Verdict{Kind: Write, Reason: "data-modifying " + strings.ToUpper(t.text)}
+		case "replace":
+			if c.dialect == MySQL && (i+1 == len(stmt) || !stmt[i+1].is(tokPunct, "(")) {
+				return Verdict{Kind: Write, Reason: "data-modifying REPLACE"}
+			}
+		}
+	}
+	return Verdict{Kind: Read, Reason: strings.ToUpper(word(stmt, 0))}
+}
+
+// function returns the name of the function called at index i if it is
+// one with side effects.
+func (c *Classifier) function(stmt []token, i int) string {
+	if i+1 == len(stmt) || !stmt[i+1].is(tokPunct, "(") {
+		return ""
+	}
+	name := stmt[i].text
+	if i >= 2 && stmt[i-1].is(tokPunct, ".") && stmt[i-2].kind == tokWord {
+		if qualified := stmt[i-2].text + "." + name; c.functions[qualified] {
+			return qualified
+		}
+	}
+	if c.functions[name] {
+		return name
+	}
+	return ""
+}
+
+// explain classifies EXPLAIN, which only reads unless it is told to
+// execute the statement with ANALYZE.
+func (c *Classifier) explain(stmt []token) Verdict {
+	analyze := false
+	for i := 1; i < len(stmt); i++ {
+		switch word(stmt, i) {
+		case "analyze", "analyse":
+			analyze = true
+		case "select", "values", "table", "with", "insert", "update", "delete", "merge", "replace",
+			"execute", "create", "declare":
+			if !analyze {
+				return Verdict{Kind: Read, Reason: "EXPLAIN"}
+			}
+			v := c.statement(stmt[i:])
+			v.Reason = "EXPLAIN ANALYZE " + v.Reason
+			return v
+		}
+	}
+	return Verdict{Kind: Read, Reason: strings.ToUpper(word(stmt, 0))}
+}
+
+// show classifies SHOW, which reads, except for the MySQL forms reporting
+// on the previous statements of the session.
+func (c *Classifier) show(stmt []token) Verdict {
+	if c.dialect == MySQL {
+		switch what := word(stmt, 1); what {
+		case "warnings", "errors", "count", "profile", "profiles":
+			return Verdict{Kind: Session, Reason: "SHOW " + strings.ToUpper(what)}
+		}
+	}
+	return Verdict{Kind: Read, Reason: "SHOW"}
+}
+
+// set classifies SET, which changes session state. Transaction
+// characteristics and MySQL autocommit control transactions, and MySQL
+// global variables are server configuration. PostgreSQL SET LOCAL, which
+// only lasts until the end of the transaction, is reported as such.
+func (c *Classifier) set(stmt []token) Verdict {
+	scoped := false
+	set := "SET"
+	for i := 1; i < len(stmt); i++ {
+		t := stmt[i]
+		name := t.text
+		if t.kind == tokVariable {
+			if len(name) > 2 && name[1] == '@' {
+				name = name[2:]
+				if scope, rest, ok := strings.Cut(name, "."); ok {
+					if scope == "global" || scope == "persist" || scope == "persist_only" {
+						return Verdict{Kind: Write, Reason: "SET GLOBAL"}
+					}
+					name = rest
+				}
+			} else {
+				return Verdict{Kind: Session, Reason: "SET user variable"}
+			}
+		} else if t.kind != tokWord {
+			return Verdict{Kind: Session, Reason: "SET"}
+		}
+		switch name {
+		case "session", "local":
+			scoped = true
+			if name == "local" && c.dialect == PostgreSQL {
+				set = "SET LOCAL"
+			}
+			continue
+		case "global", "persist", "persist_only":
+			if c.dialect == MySQL {
+				return Verdict{Kind: Write, Reason: "SET " + strings.ToUpper(name)}
+			}
+		case "transaction":
+			// with a scope, the characteristics of all later transactions
+			return Verdict{Kind: Transaction, Reason: "SET TRANSACTION", ReadOnly: !scoped && readOnly(stmt)}
+		case "characteristics":
+			return Verdict{Kind: Transaction, Reason: "SET TRANSACTION"}
+		case "autocommit":
+			if c.dialect == MySQL {
+				return Verdict{Kind: Transaction, Reason: "SET autocommit"}
+			}
+		}
+		return Verdict{Kind: Session, Reason: set + " " + name}
+	}
+	return Verdict{Kind: Session, Reason: set}
+}
+
+// readOnly reports whether the transaction modes of stmt include READ ONLY.
+func readOnly(stmt []token) bool {
+	for i := range stmt {
+		if word(stmt, i) == "read" && word(stmt, i+1) == "only" {
+			return true
+		}
+	}
+	return false
+}
+
+// Tables returns the lower case names of the tables query refers to,
+// schema qualified if written so. Names are found after the keywords
+// introducing tables, so tables read in subqueries are included while
+// those of views and functions are not.
+func (c *Classifier) Tables(query string) []string {
+	var tables []string
+	for _, stmt := range splitStatements(lex(c.dialect, query)) {
+		for i := range stmt {
+			keyword := word(stmt, i)
+			switch keyword {
+			case "from", "join", "update", "into", "table":
+			default:
+				continue
+			}
+			if i > 0 && stmt[i-1].is(tokPunct, ".") {
+				continue
+			}
+			if prev := word(stmt, i-1); keyword == "update" && (prev == "for" || prev == "key") {
+				// FOR UPDATE, ON DUPLICATE KEY UPDATE
+				continue
+			}
+			// FROM and UPDATE may list several tables with aliases
+			list := keyword == "from" || keyword == "update"
+			for j := i + 1; ; {
+				if w := word(stmt, j); w == "only" || w == "lateral" {
+					j++
+				}
+				name, next := tableName(stmt, j)
+				if name == "" {
+					break
+				}
+				tables = append(tables, name)
+				j = next
+				if word(stmt, j) == "as" {
+					j++
+				}
+				if j < len(stmt) && (stmt[j].kind == tokWord || stmt[j].kind == tokQuotedIdent) && !keywords[word(stmt, j)] {
+					j++
+				}
+				if !list || j >= len(stmt) || !stmt[j].is(tokPunct, ",") {
+					break
+				}
+				j++
+			}
+		}
+	}
+	return tables
+}
+
+// keywords that may follow a table name and are no alias
+var keywords = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true, "full": true, "cross": true,
+	"natural": true, "on": true, "using": true, "group": true, "order": true, "having": true, "limit": true,
+	"offset": true, "union": true, "intersect": true, "except": true, "window": true, "set": true,
+	"for": true, "lock": true, "returning": true, "values": true, "select": true, "partition": true,
+	"straight_join": true, "force": true, "ignore": true, "use": true, "tablesample": true, "fetch": true,
+}
+
+// tableName reads a possibly qualified name at index i, returning it and
+// the index following it, or "" if there is none.
+func tableName(stmt []token, i int) (string, int) {
+	var parts []string
+	for i < len(stmt) {
+		t := stmt[i]
+		switch t.kind {
+		case tokWord:
+			if len(parts) == 0 && keywords[t.text] {
+				return "", i
+			}
+			parts = append(parts, t.text)
+		case tokQuotedIdent:
+			quote := t.text[:1]
+			name := strings.TrimSuffix(t.text[1:], quote)
+			parts = append(parts, strings.ToLower(strings.ReplaceAll(name, quote+quote, quote)))
+		default:
+			return "", i
+		}
+		i++
+		if i == len(stmt) || !stmt[i].is(tokPunct, ".") {
+			break
+		}
+		i++
+	}
+	return strings.Join(parts, "."), i
+}
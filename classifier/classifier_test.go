@@ -0,0 +1,219 @@
+package classifier
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		dialect    Dialect
+		query      string
+		kind       Kind
+		reason     string
+		statements int
+	}{
+		{MySQL, "SELECT * FROM t", Read, "SELECT", 1},
+		{MySQL, "select id from t where name = 'update'", Read, "SELECT", 1},
+		{MySQL, "/* leading */ SELECT 1", Read, "SELECT", 1},
+		{MySQL, "SELECT * FROM t FOR UPDATE", Write, "locking read FOR UPDATE", 1},
+		{MySQL, "SELECT * FROM t LOCK IN SHARE MODE", Write, "locking read LOCK IN SHARE MODE", 1},
+		{MySQL, "SELECT @x", Session, "user variable @x", 1},
+		{MySQL, "SELECT @@version", Read, "SELECT", 1},
+		{MySQL, "SELECT GET_LOCK('a', 1)", Write, "function get_lock", 1},
+		{MySQL, "SELECT 1; SELECT 2", Read, "SELECT", 2},
+		{MySQL, "SELECT 1; DELETE FROM t", Write, "DELETE", 2},
+		{MySQL, "INSERT INTO t VALUES (1)", Write, "INSERT", 1},
+		{MySQL, "SHOW TABLES", Read, "SHOW", 1},
+		{MySQL, "SHOW WARNINGS", Session, "SHOW WARNINGS", 1},
+		{MySQL, "EXPLAIN SELECT 1", Read, "EXPLAIN", 1},
+		{MySQL, "BEGIN", Transaction, "BEGIN", 1},
+		{MySQL, "START TRANSACTION READ ONLY", Transaction, "START TRANSACTION", 1},
+		{MySQL, "SET TRANSACTION READ ONLY", Transaction, "SET TRANSACTION", 1},
+		{MySQL, "SET autocommit = 0", Transaction, "SET autocommit", 1},
+		{MySQL, "SET GLOBAL max_connections = 10", Write, "SET GLOBAL", 1},
+		{MySQL, "SET @@global.max_connections = 10", Write, "SET GLOBAL", 1},
+		{MySQL, "SET @x = 1", Session, "SET user variable", 1},
+		{MySQL, "SET time_zone = '+00:00'", Session, "SET time_zone", 1},
+		{MySQL, "USE db", Session, "USE", 1},
+		{MySQL, "LOCK TABLES t READ", Session, "LOCK TABLES", 1},
+		{MySQL, "", Write, "empty query", 0},
+		{MySQL, "FROBNICATE", Write, "FROBNICATE", 1},
+		{PostgreSQL, "SELECT * FROM t", Read, "SELECT", 1},
+		{PostgreSQL, "SELECT nextval('s')", Write, "function nextval", 1},
+		{PostgreSQL, "SELECT $$update$$", Read, "SELECT", 1},
+		{PostgreSQL, "BEGIN READ ONLY", Transaction, "BEGIN", 1},
+		{PostgreSQL, "PREPARE TRANSACTION 'x'", Transaction, "PREPARE TRANSACTION", 1},
+		{PostgreSQL, "PREPARE q AS SELECT 1", Session, "PREPARE", 1},
+		{PostgreSQL, "LISTEN ch", Session, "LISTEN", 1},
+		{PostgreSQL, "LOCK TABLE t", Write, "LOCK", 1},
+		{PostgreSQL, "SET search_path = s", Session, "SET search_path", 1},
+		{PostgreSQL, "SET LOCAL statement_timeout = 5000", Session, "SET LOCAL statement_timeout", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			v := New(tt.dialect, nil).Classify(tt.query)
+			if v.Kind != tt.kind || v.Reason != tt.reason || v.Statements != tt.statements {
+				t.Errorf("Classify() = %v, %d statements, want %v (%s), %d statements",
+					v, v.Statements, tt.kind, tt.reason, tt.statements)
+			}
+		})
+	}
+}
+
+func TestClassifyReadOnly(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		query    string
+		readOnly bool
+	}{
+		{MySQL, "START TRANSACTION READ ONLY", true},
+		{MySQL, "START TRANSACTION", false},
+		{MySQL, "SET TRANSACTION READ ONLY", true},
+		{MySQL, "SET SESSION TRANSACTION READ ONLY", false},
+		{MySQL, "SELECT 1", false},
+		{PostgreSQL, "BEGIN READ ONLY", true},
+		{PostgreSQL, "BEGIN ISOLATION LEVEL SERIALIZABLE, READ ONLY", true},
+		{PostgreSQL, "BEGIN READ WRITE", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := New(tt.dialect, nil).Classify(tt.query).ReadOnly; got != tt.readOnly {
+				t.Errorf("ReadOnly = %v, want %v", got, tt.readOnly)
+			}
+		})
+	}
+}
+
+func TestClassifyFunctions(t *testing.T) {
+	c := New(PostgreSQL, []string{"Audit.Log"})
+	if v := c.Classify("SELECT audit.log('x')"); v.Kind != Write {
+		t.Errorf("Classify() = %v, want a write", v)
+	}
+	if v := c.Classify("SELECT log('x')"); v.Kind != Read {
+		t.Errorf("Classify() = %v, want a read", v)
+	}
+}
+
+func TestClassifyDatabase(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		query    string
+		database string
+	}{
+		{MySQL, "USE Sales", "Sales"},
+		{MySQL, "USE `my``db`", "my`db"},
+		{MySQL, "USE a; USE b", "b"},
+		{MySQL, "SELECT 1", ""},
+		{PostgreSQL, "USE sales", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := New(tt.dialect, nil).Classify(tt.query).Database; got != tt.database {
+				t.Errorf("Database = %q, want %q", got, tt.database)
+			}
+		})
+	}
+}
+
+func TestClassifyState(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+		state   []StateChange
+	}{
+		{MySQL, "SELECT 1", nil},
+		{MySQL, "CREATE TEMPORARY TABLE tmp (id int)", []StateChange{{Kind: TemporaryTable, Name: "tmp"}}},
+		{MySQL, "CREATE TEMPORARY TABLE IF NOT EXISTS s.tmp (id int)", []StateChange{{Kind: TemporaryTable, Name: "s.tmp"}}},
+		{MySQL, "CREATE TABLE t (id int)", nil},
+		{MySQL, "DROP TEMPORARY TABLE IF EXISTS a, b", []StateChange{
+			{Kind: TemporaryTable, Name: "a", Release: true}, {Kind: TemporaryTable, Name: "b", Release: true}}},
+		{MySQL, "PREPARE s FROM 'SELECT 1'", []StateChange{{Kind: PreparedStatement, Name: "s"}}},
+		{MySQL, "DEALLOCATE PREPARE s", []StateChange{{Kind: PreparedStatement, Name: "s", Release: true}}},
+		{MySQL, "SET @x = 1", []StateChange{{Kind: UserVariables}}},
+		{MySQL, "SELECT GET_LOCK('a', 1)", []StateChange{{Kind: AdvisoryLocks}}},
+		{MySQL, "SELECT RELEASE_ALL_LOCKS()", []StateChange{{Kind: AdvisoryLocks, Release: true}}},
+		{MySQL, "LOCK TABLES t WRITE", []StateChange{{Kind: TableLocks}}},
+		{MySQL, "UNLOCK TABLES", []StateChange{{Kind: TableLocks, Release: true}}},
+		{MySQL, "FLUSH TABLES WITH READ LOCK", []StateChange{{Kind: TableLocks}}},
+		{PostgreSQL, "SELECT * INTO TEMP TABLE tmp FROM t", []StateChange{{Kind: TemporaryTable, Name: "tmp"}}},
+		{PostgreSQL, "DEALLOCATE ALL", []StateChange{{Kind: PreparedStatement, Release: true}}},
+		{PostgreSQL, "DECLARE c CURSOR FOR SELECT 1", []StateChange{{Kind: Cursor, Name: "c"}}},
+		{PostgreSQL, "CLOSE c", []StateChange{{Kind: Cursor, Name: "c", Release: true}}},
+		{PostgreSQL, "LISTEN ch", []StateChange{{Kind: Listener, Name: "ch"}}},
+		{PostgreSQL, "UNLISTEN *", []StateChange{{Kind: Listener, Release: true}}},
+		{PostgreSQL, "SELECT pg_advisory_lock(1)", []StateChange{{Kind: AdvisoryLocks}}},
+		{PostgreSQL, "DISCARD TEMP", []StateChange{{Kind: TemporaryTable, Release: true}}},
+		{PostgreSQL, "DISCARD ALL", []StateChange{{Release: true}}},
+		{PostgreSQL, "LOCK TABLE t", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := New(tt.dialect, nil).Classify(tt.query).State; !reflect.DeepEqual(got, tt.state) {
+				t.Errorf("State = %v, want %v", got, tt.state)
+			}
+		})
+	}
+}
+
+func TestClassifySettings(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		query    string
+		settings []Setting
+	}{
+		{MySQL, "SELECT 1", nil},
+		{MySQL, "SET time_zone = '+00:00'", []Setting{{Name: "time_zone", Value: "'+00:00'"}}},
+		{MySQL, "SET SESSION sql_mode = 'ANSI', @@session.wait_timeout := 10", []Setting{
+			{Name: "sql_mode", Value: "'ANSI'"}, {Name: "wait_timeout", Value: "10"}}},
+		{MySQL, "SET NAMES utf8mb4 COLLATE utf8mb4_bin", []Setting{{Name: "names", Value: "utf8mb4 COLLATE utf8mb4_bin"}}},
+		{MySQL, "SET CHARACTER SET utf8mb4", []Setting{{Name: "character set", Value: "utf8mb4"}}},
+		{MySQL, "SET sql_mode = DEFAULT", []Setting{{Name: "sql_mode"}}},
+		{MySQL, "SET @x = 1, GLOBAL max_connections = 10", nil},
+		{MySQL, "SET autocommit = 0", nil},
+		{MySQL, "SET TRANSACTION READ ONLY", nil},
+		{PostgreSQL, "SET search_path TO s, public", []Setting{{Name: "search_path", Value: "s, public"}}},
+		{PostgreSQL, "SET SESSION statement_timeout = 5000", []Setting{{Name: "statement_timeout", Value: "5000"}}},
+		{PostgreSQL, "SET LOCAL statement_timeout = 5000", nil},
+		{PostgreSQL, "SET TIME ZONE 'UTC'", []Setting{{Name: "timezone", Value: "'UTC'"}}},
+		{PostgreSQL, "RESET search_path", []Setting{{Name: "search_path"}}},
+		{PostgreSQL, "RESET ALL", []Setting{{}}},
+		{PostgreSQL, "DISCARD ALL", []Setting{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := New(tt.dialect, nil).Classify(tt.query).Settings; !reflect.DeepEqual(got, tt.settings) {
+				t.Errorf("Settings = %q, want %q", got, tt.settings)
+			}
+		})
+	}
+}
+
+func TestTables(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		query   string
+		tables  []string
+	}{
+		{MySQL, "SELECT 1", nil},
+		{MySQL, "SELECT * FROM Orders", []string{"orders"}},
+		{MySQL, "SELECT * FROM shop.orders o JOIN items AS i ON o.id = i.order_id", []string{"shop.orders", "items"}},
+		{MySQL, "SELECT * FROM a, b x, c WHERE a.id = b.id", []string{"a", "b", "c"}},
+		{MySQL, "SELECT * FROM `order`", []string{"order"}},
+		{MySQL, "SELECT * FROM a WHERE id IN (SELECT id FROM b)", []string{"a", "b"}},
+		{MySQL, "INSERT INTO t VALUES (1) ON DUPLICATE KEY UPDATE v = 1", []string{"t"}},
+		{MySQL, "UPDATE t SET v = 1", []string{"t"}},
+		{MySQL, "SELECT * FROM t FOR UPDATE", []string{"t"}},
+		{MySQL, "DELETE FROM t; SELECT * FROM u", []string{"t", "u"}},
+		{PostgreSQL, "SELECT * FROM ONLY parent", []string{"parent"}},
+		{PostgreSQL, `SELECT * FROM "Mixed"."Case"`, []string{"mixed.case"}},
+		{PostgreSQL, "TABLE t", []string{"t"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := New(tt.dialect, nil).Tables(tt.query); !reflect.DeepEqual(got, tt.tables) {
+				t.Errorf("Tables() = %q, want %q", got, tt.tables)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package classifier
+
+// Functions that change data, take locks or depend on the session, so that
+// a query calling them must run on the main server even if it only reads.
+var (
+	mysqlFunctions = []string{
+		"get_lock", "release_lock", "release_all_locks", "is_free_lock", "is_used_lock",
+		"last_insert_id", "found_rows", "row_count", "connection_id",
+		"nextval", "setval", "lastval",
+	}
+	postgresFunctions = []string{
+		"nextval", "setval", "currval", "lastval",
+		"pg_advisory_lock", "pg_advisory_lock_shared", "pg_advisory_xact_lock", "pg_advisory_xact_lock_shared",
+		"pg_try_advisory_lock", "pg_try_advisory_lock_shared", "pg_try_advisory_xact_lock",
+		"pg_try_advisory_xact_lock_shared", "pg_advisory_unlock", "pg_advisory_unlock_shared",
+		"pg_advisory_unlock_all",
+		"set_config", "txid_current", "pg_current_xact_id", "pg_notify", "pg_backend_pid",
+		"pg_cancel_backend", "pg_terminate_backend", "pg_current_wal_lsn", "pg_current_wal_insert_lsn",
+		"pg_switch_wal", "pg_create_restore_point", "pg_logical_emit_message",
+		"lo_create", "lo_creat", "lo_import", "lo_unlink", "lo_from_bytea", "lo_put",
+	}
+)
+
+// Functions taking advisory locks held by the session until released, and
+// releasing all of them.
+var (
+	advisoryLockFunctions = map[string]bool{
+		"get_lock": true, "pg_advisory_lock": true, "pg_advisory_lock_shared": true,
+		"pg_try_advisory_lock": true, "pg_try_advisory_lock_shared": true,
+	}
+	advisoryUnlockAllFunctions = map[string]bool{
+		"release_all_locks": true, "pg_advisory_unlock_all": true,
+	}
+)
@@ -0,0 +1,82 @@
+package classifier
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const hintPrefix = "dbrwproxy:"
+
+// Routing hints override the verdict for a query.
+const (
+	RouteMain    = "main"
+	RouteReplica = "replica"
+)
+
+// Hints are routing directives given in comments leading or trailing a
+// query, such as /* dbrwproxy:route=replica name=B max_lag=2s */.
+type Hints struct {
+	// Route is RouteMain or RouteReplica, or empty to follow the verdict.
+	Route string
+	// Name selects the secondary to read from.
+	Name string
+	// MaxLag is the replication lag a secondary may have to be read from.
+	MaxLag time.Duration
+}
+
+// Hints returns the routing hints of query and the query without the
+// comments holding them. Hints that cannot be parsed are reported in err,
+// the others are still returned.
+func (c *Classifier) Hints(query string) (hints Hints, stripped string, err error) {
+	tokens := lex(c.dialect, query)
+	first, last := 0, len(tokens)-1
+	for first < len(tokens) && tokens[first].kind == tokComment {
+		first++
+	}
+	for last >= 0 && (tokens[last].kind == tokComment || tokens[last].is(tokPunct, ";")) {
+		last--
+	}
+
+	var b strings.Builder
+	pos := 0
+	for i, t := range tokens {
+		if t.kind != tokComment || i > first && i < last || !strings.HasPrefix(t.text, hintPrefix) {
+			continue
+		}
+		if hintErr := hints.parse(t.text[len(hintPrefix):]); hintErr != nil && err == nil {
+			err = hintErr
+		}
+		b.WriteString(query[pos:t.start])
+		pos = t.end
+	}
+	if pos == 0 {
+		return hints, query, err
+	}
+	b.WriteString(query[pos:])
+	return hints, strings.TrimSpace(b.String()), err
+}
+
+func (h *Hints) parse(s string) error {
+	for _, field := range strings.Fields(s) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "route":
+			if value != RouteMain && value != RouteReplica {
+				return fmt.Errorf("invalid routing hint %s", field)
+			}
+			h.Route = value
+		case "name":
+			h.Name = value
+		case "max_lag":
+			lag, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid routing hint %s: %w", field, err)
+			}
+			h.MaxLag = lag
+		default:
+			return fmt.Errorf("unknown routing hint %s", field)
+		}
+	}
+	return nil
+}
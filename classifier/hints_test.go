@@ -0,0 +1,33 @@
+package classifier
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHints(t *testing.T) {
+	tests := []struct {
+		query    string
+		hints    Hints
+		stripped string
+		err      bool
+	}{
+		{"SELECT 1", Hints{}, "SELECT 1", false},
+		{"/* dbrwproxy:route=main */ SELECT 1", Hints{Route: RouteMain}, "SELECT 1", false},
+		{"SELECT 1 /* dbrwproxy:route=replica name=B max_lag=2s */;", Hints{Route: RouteReplica, Name: "B", MaxLag: 2 * time.Second}, "SELECT 1 ;", false},
+		{"/* comment */ /* dbrwproxy:name=A */ SELECT 1", Hints{Name: "A"}, "/* comment */  SELECT 1", false},
+		{"SELECT /* dbrwproxy:route=main */ 1", Hints{}, "SELECT /* dbrwproxy:route=main */ 1", false},
+		{"SELECT '/* dbrwproxy:route=main */'", Hints{}, "SELECT '/* dbrwproxy:route=main */'", false},
+		{"/* dbrwproxy:route=primary */ SELECT 1", Hints{}, "SELECT 1", true},
+		{"/* dbrwproxy:max_lag=soon route=main */ SELECT 1", Hints{}, "SELECT 1", true},
+		{"/* dbrwproxy:color=blue */ /* dbrwproxy:route=main */ SELECT 1", Hints{Route: RouteMain}, "SELECT 1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			hints, stripped, err := New(MySQL, nil).Hints(tt.query)
+			if hints != tt.hints || stripped != tt.stripped || (err != nil) != tt.err {
+				t.Errorf("Hints() = %+v, %q, %v, want %+v, %q, error %v", hints, stripped, err, tt.hints, tt.stripped, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package classifier
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokQuotedIdent
+	tokString
+	tokNumber
+	// tokVariable is a MySQL user (@name) or system (@@name) variable.
+	tokVariable
+	tokPunct
+	tokComment
+)
+
+type token struct {
+	kind tokenKind
+	// text is lower case for words, the comment body for comments, and the
+	// source text otherwise.
+	text string
+	// start and end locate the token in the source.
+	start, end int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+// lex splits sql into tokens. Comments are kept so that routing hints can
+// be read from them, strings and quoted identifiers are kept as a single
+// token so their contents are never mistaken for keywords.
+func lex(dialect Dialect, sql string) []token {
+	l := &lexer{dialect: dialect, src: sql}
+	l.run()
+	return l.tokens
+}
+
+type lexer struct {
+	dialect Dialect
+	src     string
+	pos     int
+	tokens  []token
+	// start is the position of the token being read
+	start int
+	// executable counts the MySQL /*! ... */ comments the lexer is in,
+	// whose contents are statement text.
+	executable int
+}
+
+// emit adds a token ending at the current position.
+func (l *lexer) emit(kind tokenKind, text string) {
+	l.tokens = append(l.tokens, token{kind: kind, text: text, start: l.start, end: l.pos})
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *lexer) run() {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.start = l.pos
+		switch {
+		case isSpace(c):
+			l.pos++
+		case c == '#' && l.dialect == MySQL:
+			l.lineComment(1)
+		case c == '-' && l.peek(1) == '-' && (l.dialect != MySQL || isSpace(l.peek(2)) || l.pos+2 == len(l.src)):
+			// MySQL requires whitespace after the dashes
+			l.lineComment(2)
+		case c == '/' && l.peek(1) == '*':
+			l.blockComment()
+		case c == '*' && l.peek(1) == '/' && l.executable > 0:
+			l.executable--
+			l.pos += 2
+		case c == '\'':
+			l.quoted(c, tokString, l.dialect == MySQL)
+		case (c == 'e' || c == 'E') && l.peek(1) == '\'' && l.dialect == PostgreSQL:
+			l.pos++
+			l.quoted('\'', tokString, true)
+		case c == '"':
+			if l.dialect == MySQL {
+				l.quoted(c, tokString, true)
+			} else {
+				l.quoted(c, tokQuotedIdent, false)
+			}
+		case c == '`' && l.dialect == MySQL:
+			l.quoted(c, tokQuotedIdent, false)
+		case c == '$' && l.dialect == PostgreSQL && l.dollarQuoted():
+		case c == '@' && l.dialect == MySQL:
+			l.variable()
+		case isIdentStart(c, l.dialect):
+			start := l.pos
+			for l.pos < len(l.src) && isIdentPart(l.src[l.pos], l.dialect) {
+				l.pos++
+			}
+			l.emit(tokWord, strings.ToLower(l.src[start:l.pos]))
+		case isDigit(c):
+			start := l.pos
+			for l.pos < len(l.src) && (isIdentPart(l.src[l.pos], l.dialect) || l.src[l.pos] == '.') {
+				l.pos++
+			}
+			l.emit(tokNumber, l.src[start:l.pos])
+		case c == ':' && l.peek(1) == '=':
+			l.pos += 2
+			l.emit(tokPunct, ":=")
+		default:
+			l.pos++
+			l.emit(tokPunct, l.src[l.start:l.pos])
+		}
+	}
+}
+
+func (l *lexer) lineComment(prefix int) {
+	start := l.pos + prefix
+	end := strings.IndexByte(l.src[start:], '\n')
+	if end < 0 {
+		end = len(l.src) - start
+	}
+	l.pos = start + end
+	l.emit(tokComment, strings.TrimSpace(l.src[start:l.pos]))
+}
+
+func (l *lexer) blockComment() {
+	if l.dialect == MySQL && l.peek(2) == '!' {
+		// executable comment, optionally limited to a server version
+		l.pos += 3
+		for isDigit(l.peek(0)) {
+			l.pos++
+		}
+		l.executable++
+		return
+	}
+	// PostgreSQL block comments nest, MySQL ones do not
+	depth := 0
+	start := l.pos + 2
+	for l.pos < len(l.src) {
+		switch {
+		case l.src[l.pos] == '/' && l.peek(1) == '*' && (depth == 0 || l.dialect == PostgreSQL):
+			depth++
+			l.pos += 2
+		case l.src[l.pos] == '*' && l.peek(1) == '/':
+			depth--
+			l.pos += 2
+			if depth == 0 {
+				l.emit(tokComment, strings.TrimSpace(l.src[start:l.pos-2]))
+				return
+			}
+		default:
+			l.pos++
+		}
+	}
+	// unterminated
+	l.pos = len(l.src)
+	l.emit(tokComment, strings.TrimSpace(l.src[start:]))
+}
+
+// quoted reads a literal enclosed in quote, where a doubled quote stands
+// for itself and, if backslashes is set, a backslash escapes any byte.
+func (l *lexer) quoted(quote byte, kind tokenKind, backslashes bool) {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\\' && backslashes:
+			l.pos += 2
+		case c == quote && l.peek(1) == quote:
+			l.pos += 2
+		case c == quote:
+			l.pos++
+			l.emit(kind, l.src[start:l.pos])
+			return
+		default:
+			l.pos++
+		}
+	}
+	if l.pos > len(l.src) {
+		l.pos = len(l.src)
+	}
+	l.emit(kind, l.src[start:])
+}
+
+// dollarQuoted reads a PostgreSQL dollar-quoted string, reporting false if
+// the dollar sign does not open one, as in a $1 parameter.
+func (l *lexer) dollarQuoted() bool {
+	end := l.pos + 1
+	for end < len(l.src) && l.src[end] != '$' {
+		if !isIdentPart(l.src[end], PostgreSQL) || end == l.pos+1 && isDigit(l.src[end]) {
+			return false
+		}
+		end++
+	}
+	if end == len(l.src) {
+		return false
+	}
+	tag := l.src[l.pos : end+1]
+	closing := strings.Index(l.src[end+1:], tag)
+	if closing < 0 {
+		l.pos = len(l.src)
+	} else {
+		l.pos = closing + end + 1 + len(tag)
+	}
+	l.emit(tokString, l.src[l.start:l.pos])
+	return true
+}
+
+func (l *lexer) variable() {
+	start := l.pos
+	l.pos++
+	if l.peek(0) == '@' {
+		l.pos++
+	}
+	switch c := l.peek(0); c {
+	case '\'', '"', '`':
+		l.quoted(c, tokVariable, c != '`')
+		// replace the quoted token with the whole variable
+		l.tokens = l.tokens[:len(l.tokens)-1]
+	default:
+		for l.pos < len(l.src) && (isIdentPart(l.src[l.pos], MySQL) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+	}
+	l.emit(tokVariable, strings.ToLower(l.src[start:l.pos]))
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte, dialect Dialect) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80 ||
+		c == '$' && dialect == MySQL
+}
+
+func isIdentPart(c byte, dialect Dialect) bool {
+	return isIdentStart(c, dialect) || isDigit(c) || c == '$'
+}
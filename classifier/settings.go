@@ -0,0 +1,177 @@
+package classifier
+
+import (
+	"strings"
+)
+
+// Setting is a session variable a statement sets, with the expression it
+// is set to as written. An empty Value resets the variable to its default,
+// an empty Name resets all variables.
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// Variables that are not replayed on other connections: they control
+// transactions, credentials or replication, not how statements run.
+var skippedSettings = map[string]bool{
+	"autocommit": true, "password": true, "sql_log_bin": true, "session_track_gtids": true,
+}
+
+// settings returns the session variables stmt, read from query, sets, in
+// order. Variables of the current transaction only, and settings that are
+// no variables, such as roles, are left out.
+func (c *Classifier) settings(query string, stmt []token) []Setting {
+	switch word(stmt, 0) {
+	case "set":
+		if c.dialect == MySQL {
+			return mysqlSettings(query, stmt[1:])
+		}
+		if setting, ok := postgresSetting(query, stmt[1:]); ok {
+			return []Setting{setting}
+		}
+	case "reset":
+		if c.dialect != PostgreSQL {
+			break
+		}
+		switch w := word(stmt, 1); {
+		case w == "all" && len(stmt) == 2:
+			return []Setting{{}}
+		case w == "time" && word(stmt, 2) == "zone":
+			return []Setting{{Name: "timezone"}}
+		case w == "role" || w == "session":
+		default:
+			if name, _ := tableName(stmt, 1); name != "" {
+				return []Setting{{Name: name}}
+			}
+		}
+	case "discard":
+		if c.dialect == PostgreSQL && word(stmt, 1) == "all" {
+			return []Setting{{}}
+		}
+	}
+	return nil
+}
+
+// mysqlSettings reads the assignments of a MySQL SET statement.
+func mysqlSettings(query string, stmt []token) []Setting {
+	var settings []Setting
+	for _, item := range splitList(stmt) {
+		name, i := mysqlVariable(item)
+		if name == "" || skippedSettings[name] || i >= len(item) {
+			continue
+		}
+		value := source(query, item[i:])
+		if len(item) == i+1 && word(item, i) == "default" {
+			value = ""
+		}
+		settings = append(settings, Setting{Name: name, Value: value})
+	}
+	return settings
+}
+
+// mysqlVariable returns the name of the session variable an assignment
+// sets and the index of its value, or "" if it sets none. SET NAMES and
+// SET CHARACTER SET are returned as the variables "names" and
+// "character set".
+func mysqlVariable(item []token) (string, int) {
+	i := 0
+	switch word(item, 0) {
+	case "session", "local":
+		i++
+	case "global", "persist", "persist_only":
+		return "", 0
+	}
+	if i >= len(item) {
+		return "", 0
+	}
+	var name string
+	switch t := item[i]; {
+	case t.kind == tokVariable:
+		if len(t.text) < 3 || t.text[1] != '@' {
+			// a user variable
+			return "", 0
+		}
+		name = t.text[2:]
+		if scope, rest, ok := strings.Cut(name, "."); ok {
+			if scope != "session" && scope != "local" {
+				return "", 0
+			}
+			name = rest
+		}
+	case t.kind != tokWord:
+		return "", 0
+	case t.text == "names":
+		return "names", i + 1
+	case t.text == "charset":
+		return "character set", i + 1
+	case t.text == "character" && word(item, i+1) == "set":
+		return "character set", i + 2
+	default:
+		name = t.text
+	}
+	if i+1 < len(item) && (item[i+1].is(tokPunct, "=") || item[i+1].is(tokPunct, ":=")) {
+		return name, i + 2
+	}
+	return "", 0
+}
+
+// postgresSetting reads a PostgreSQL SET statement.
+func postgresSetting(query string, stmt []token) (Setting, bool) {
+	i := 0
+	switch word(stmt, 0) {
+	case "session":
+		i++
+	case "local":
+		return Setting{}, false
+	}
+	var name string
+	switch w := word(stmt, i); {
+	case w == "time" && word(stmt, i+1) == "zone":
+		name, i = "timezone", i+2
+	case w == "schema":
+		name, i = "search_path", i+1
+	case w == "names":
+		name, i = "client_encoding", i+1
+	case w == "xml" && word(stmt, i+1) == "option":
+		name, i = "xmloption", i+2
+	default:
+		var next int
+		name, next = tableName(stmt, i)
+		if name == "" || next >= len(stmt) || word(stmt, next) != "to" && !stmt[next].is(tokPunct, "=") {
+			return Setting{}, false
+		}
+		i = next + 1
+	}
+	if i >= len(stmt) || skippedSettings[name] {
+		return Setting{}, false
+	}
+	value := source(query, stmt[i:])
+	if w := word(stmt, i); len(stmt) == i+1 && (w == "default" || w == "local" && name == "timezone") {
+		value = ""
+	}
+	return Setting{Name: name, Value: value}, true
+}
+
+// splitList splits stmt at the commas outside parentheses.
+func splitList(stmt []token) [][]token {
+	var items [][]token
+	depth, start := 0, 0
+	for i, t := range stmt {
+		switch {
+		case t.is(tokPunct, "("):
+			depth++
+		case t.is(tokPunct, ")"):
+			depth--
+		case t.is(tokPunct, ",") && depth == 0:
+			items = append(items, stmt[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, stmt[start:])
+}
+
+// source returns the text of query stmt was read from.
+func source(query string, stmt []token) string {
+	return query[stmt[0].start:stmt[len(stmt)-1].end]
+}
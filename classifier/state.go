@@ -0,0 +1,192 @@
+package classifier
+
+// Kinds of session-scoped state a statement can create on the server it
+// runs on.
+const (
+	TemporaryTable    = "temporary table"
+	PreparedStatement = "prepared statement"
+	Cursor            = "cursor"
+	Listener          = "LISTEN"
+	TableLocks        = "table locks"
+	AdvisoryLocks     = "advisory locks"
+	UserVariables     = "user variables"
+)
+
+// StateChange is session-scoped state a statement creates or releases.
+// Later statements of the session may depend on the state, so they must
+// run on the server holding it.
+type StateChange struct {
+	// Kind is the kind of state, or "" when all state is released.
+	Kind string
+	// Name identifies the state among that of its kind. It is "" for
+	// unnamed state and, when released, for all state of the kind.
+	Name    string
+	Release bool
+}
+
+func (s StateChange) String() string {
+	if s.Name == "" {
+		return s.Kind
+	}
+	return s.Kind + " " + s.Name
+}
+
+// state returns the session-scoped state stmt creates or releases, in
+// order. Advisory locks taken one by one are only released all at once,
+// as whether a lock was taken depends on the result of the call.
+func (c *Classifier) state(stmt []token) []StateChange {
+	var changes []StateChange
+	hold := func(kind, name string) {
+		changes = append(changes, StateChange{Kind: kind, Name: name})
+	}
+	release := func(kind, name string) {
+		changes = append(changes, StateChange{Kind: kind, Name: name, Release: true})
+	}
+	for i, t := range stmt {
+		switch {
+		case t.kind == tokVariable && (len(t.text) < 2 || t.text[1] != '@'):
+			hold(UserVariables, "")
+		case t.kind != tokWord || i+1 == len(stmt) || !stmt[i+1].is(tokPunct, "("):
+		case advisoryLockFunctions[t.text]:
+			hold(AdvisoryLocks, "")
+		case advisoryUnlockAllFunctions[t.text]:
+			release(AdvisoryLocks, "")
+		}
+		if t.kind == tokWord && t.text == "into" && c.dialect == PostgreSQL {
+			// SELECT ... INTO TEMPORARY TABLE name
+			if j := temporary(stmt, i+1); j > i+1 {
+				if word(stmt, j) == "table" {
+					j++
+				}
+				if name, _ := tableName(stmt, j); name != "" {
+					hold(TemporaryTable, name)
+				}
+			}
+		}
+	}
+
+	switch word(stmt, 0) {
+	case "create":
+		j := temporary(stmt, 1)
+		if j == 1 || word(stmt, j) != "table" {
+			break
+		}
+		j++
+		if word(stmt, j) == "if" && word(stmt, j+1) == "not" && word(stmt, j+2) == "exists" {
+			j += 3
+		}
+		if name, _ := tableName(stmt, j); name != "" {
+			hold(TemporaryTable, name)
+		}
+	case "drop":
+		j := 1
+		if word(stmt, j) == "temporary" {
+			j++
+		}
+		switch word(stmt, j) {
+		case "table":
+			j++
+			if word(stmt, j) == "if" && word(stmt, j+1) == "exists" {
+				j += 2
+			}
+			for {
+				name, next := tableName(stmt, j)
+				if name == "" {
+					break
+				}
+				release(TemporaryTable, name)
+				if next >= len(stmt) || !stmt[next].is(tokPunct, ",") {
+					break
+				}
+				j = next + 1
+			}
+		case "prepare":
+			if name, _ := tableName(stmt, j+1); name != "" {
+				release(PreparedStatement, name)
+			}
+		}
+	case "prepare":
+		if word(stmt, 1) == "transaction" {
+			break
+		}
+		if name, _ := tableName(stmt, 1); name != "" {
+			hold(PreparedStatement, name)
+		}
+	case "deallocate":
+		j := 1
+		if word(stmt, j) == "prepare" {
+			j++
+		}
+		if name, _ := tableName(stmt, j); name != "" {
+			release(PreparedStatement, all(name))
+		}
+	case "declare":
+		for j := 2; j < len(stmt); j++ {
+			if word(stmt, j) == "cursor" {
+				if name, _ := tableName(stmt, 1); name != "" {
+					hold(Cursor, name)
+				}
+				break
+			}
+		}
+	case "close":
+		if name, _ := tableName(stmt, 1); name != "" {
+			release(Cursor, all(name))
+		}
+	case "listen":
+		if name, _ := tableName(stmt, 1); name != "" {
+			hold(Listener, name)
+		}
+	case "unlisten":
+		name, _ := tableName(stmt, 1)
+		release(Listener, name)
+	case "lock":
+		if c.dialect == MySQL {
+			hold(TableLocks, "")
+		}
+	case "unlock":
+		if c.dialect == MySQL {
+			release(TableLocks, "")
+		}
+	case "flush":
+		if readLock(stmt) {
+			hold(TableLocks, "")
+		}
+	case "discard":
+		switch word(stmt, 1) {
+		case "all":
+			release("", "")
+		case "temp", "temporary":
+			release(TemporaryTable, "")
+		}
+	}
+	return changes
+}
+
+// temporary skips the words making a CREATE TABLE or SELECT INTO create a
+// temporary table from index i, returning the index following them, or i
+// if there are none.
+func temporary(stmt []token, i int) int {
+	j := i
+	if w := word(stmt, j); w == "global" || w == "local" {
+		j++
+	}
+	if w := word(stmt, j); w != "temporary" && w != "temp" {
+		return i
+	}
+	return j + 1
+}
+
+// all returns "" for the name ALL, which releases all state of a kind.
+func all(name string) string {
+	if name == "all" {
+		return ""
+	}
+	return name
+}
+
+// readLock reports whether stmt ends with WITH READ LOCK.
+func readLock(stmt []token) bool {
+	n := len(stmt)
+	return word(stmt, n-3) == "with" && word(stmt, n-2) == "read" && word(stmt, n-1) == "lock"
+}
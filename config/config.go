@@ -1,8 +1,11 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	yaml "gopkg.in/yaml.v3"
 	"io/ioutil"
+	"time"
 )
 
 type Config struct {
@@ -14,10 +17,69 @@ type Proxy struct {
 	Name   string       `yaml:"Name"`
 	Server ServerConfig `yaml:"ServerConfig"`
 	Db     DB           `yaml:"DB"`
+	// MainFunctions lists functions, in addition to the built-in ones, whose
+	// use in a query sends it to the main database.
+	MainFunctions []string `yaml:"MainFunctions"`
+	// StripHints removes routing hint comments from queries before they
+	// are sent to a database.
+	StripHints bool `yaml:"StripHints"`
+	// Rules are applied in order, the first one matching a statement
+	// decides where it goes.
+	Rules []Rule `yaml:"Rules"`
+	// Consistency keeps the reads of a session on the main database after
+	// it wrote: for ConsistencyWindow with window, for good with session.
+	// With causal, reads go to secondaries that replayed the writes, waiting
+	// up to CausalWait for one to, or stay on the main database for
+	// ConsistencyWindow, 1s by default, if the proxy cannot tell where its
+	// history was after the writes.
+	Consistency       string        `yaml:"Consistency"`
+	ConsistencyWindow time.Duration `yaml:"ConsistencyWindow"`
+	CausalWait        time.Duration `yaml:"CausalWait"`
+	// UserFile lists the users the proxy authenticates clients against
+	// itself, see ReadUsers. Without it, clients authenticate with the
+	// main database through the proxy.
+	UserFile string `yaml:"UserFile"`
+	// AuthMethod is how clients prove their password to the proxy:
+	// caching_sha2_password or mysql_native_password for MySQL,
+	// scram-sha-256 or md5 for PostgreSQL. The first one is the default.
+	AuthMethod string `yaml:"AuthMethod"`
+}
+
+// Rule routes the statements matching all of its conditions. Conditions
+// left empty match any statement.
+type Rule struct {
+	Name string `yaml:"Name"`
+	// Pattern is a regular expression the statement must match.
+	Pattern string `yaml:"Pattern"`
+	// Tables the statement must refer to one of, schema qualified or not.
+	Tables []string `yaml:"Tables"`
+	// Users and Databases the session must be logged in with.
+	Users     []string `yaml:"Users"`
+	Databases []string `yaml:"Databases"`
+	// Clients are the addresses or CIDR networks the client must connect
+	// from.
+	Clients []string `yaml:"Clients"`
+	// Route is main, secondary, group or reject. Secondary and group
+	// rules only route reads, other statements go to the main database.
+	Route string `yaml:"Route"`
+	// Target names the secondary or the group to route to.
+	Target string `yaml:"Target"`
 }
 
 type ServerConfig struct {
 	ProxyAddr string `yaml:"ProxyAddr"`
+	// TLSCert and TLSKey are the PEM files of the certificate the proxy
+	// presents to clients asking for TLS. Without them, MySQL sessions
+	// asking for TLS are relayed encrypted to the main database.
+	TLSCert string `yaml:"TLSCert"`
+	TLSKey  string `yaml:"TLSKey"`
+	// TLSClientAuth is how client certificates are checked: none, the
+	// default, optional to verify those presented against the CA of the
+	// PEM file TLSClientCA, verify-ca to require one, verify-full to also
+	// require its common name to be the user the client logs in as.
+	// Clients not using TLS are rejected with verify-ca and verify-full.
+	TLSClientAuth string `yaml:"TLSClientAuth"`
+	TLSClientCA   string `yaml:"TLSClientCA"`
 }
 
 type DB struct {
@@ -27,6 +89,18 @@ type DB struct {
 
 type MainDB struct {
 	Addr string `yaml:"Addr"`
+	// TLS is how the proxy connects to the main database itself: true to
+	// verify its certificate, skip-verify not to, preferred to use TLS
+	// without verifying the certificate if the server supports it, false,
+	// the default, for plain connections. MySQL sessions the proxy relays
+	// the authentication of use TLS to the main database only if they use
+	// it with the proxy.
+	TLS string `yaml:"TLS"`
+	// SSLMode is the libpq sslmode the proxy connects to a PostgreSQL
+	// main database with, disable by default. As with libpq, allow, prefer
+	// and require without TLSCA do not verify the certificate.
+	SSLMode    string `yaml:"SSLMode"`
+	Connection `yaml:",inline"`
 }
 
 type SecondaryDB struct {
@@ -37,9 +111,61 @@ type SecondaryDB struct {
 	Password          string `yaml:"Password"`
 	DbName            string `yaml:"DbName"`
 	Weight            int    `yaml:"Weight"`
+	Group             string `yaml:"Group"`
 	MaxIdleConnCount  int    `yaml:"MaxIdleConnCount"`
 	MaxOpenConnsCount int    `yaml:"MaxOpenConnsCount"`
 	ConnMaxLifetime   int    `yaml:"ConnMaxLifetime"`
+	// TLS is how MySQL secondaries are connected to, as for MainDB.
+	TLS string `yaml:"TLS"`
+	// SSLMode is how PostgreSQL secondaries are connected to, as for
+	// MainDB.
+	SSLMode    string `yaml:"SSLMode"`
+	Connection `yaml:",inline"`
+}
+
+// Connection holds the options of the connections the proxy opens to a
+// database. Charset, Collation, ReadTimeout and Params only apply to
+// secondaries, clients choose them for their sessions on the main
+// database.
+type Connection struct {
+	// TLSCA is the PEM file of the root certificates the certificate of
+	// the server is verified against instead of the system ones, TLSCert
+	// and TLSKey those of the certificate the proxy presents to it.
+	TLSCA   string `yaml:"TLSCA"`
+	TLSCert string `yaml:"TLSCert"`
+	TLSKey  string `yaml:"TLSKey"`
+	// ConnectTimeout bounds dialing the server, ReadTimeout and
+	// WriteTimeout each read and write of a connection.
+	ConnectTimeout time.Duration `yaml:"ConnectTimeout"`
+	ReadTimeout    time.Duration `yaml:"ReadTimeout"`
+	WriteTimeout   time.Duration `yaml:"WriteTimeout"`
+	// Charset is the character set of MySQL connections, the
+	// client_encoding of PostgreSQL ones. Collation is MySQL only.
+	Charset   string `yaml:"Charset"`
+	Collation string `yaml:"Collation"`
+	// Params are further parameters of the driver: those of the DSN of
+	// MySQL, the run-time parameters sent at startup for PostgreSQL.
+	Params map[string]string `yaml:"Params"`
+}
+
+// Users is the content of a user file.
+type Users struct {
+	Users []User `yaml:"Users"`
+}
+
+// User is a client the proxy authenticates. Its sessions log in to the
+// main database and to the secondaries with the credentials of Main and
+// Secondary, or with its own where these are left empty.
+type User struct {
+	Name      string      `yaml:"Name"`
+	Password  string      `yaml:"Password"`
+	Main      Credentials `yaml:"Main"`
+	Secondary Credentials `yaml:"Secondary"`
+}
+
+type Credentials struct {
+	User     string `yaml:"User"`
+	Password string `yaml:"Password"`
 }
 
 func ReadConfig(name string) (Config, error) {
@@ -56,3 +182,29 @@ func ReadConfig(name string) (Config, error) {
 
 	return conf, nil
 }
+
+// ReadUsers reads a user file, returning its users by name.
+func ReadUsers(name string) (map[string]User, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var list Users
+	err = yaml.Unmarshal(content, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]User)
+	for _, user := range list.Users {
+		if user.Name == "" {
+			return nil, errors.New("user without Name")
+		}
+		if _, ok := users[user.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", user.Name)
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
@@ -4,8 +4,6 @@ go 1.20
 
 require (
 	github.com/jackc/pgx/v5 v5.4.3
-	github.com/jmoiron/sqlx v1.3.5
-	github.com/lib/pq v1.10.9
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -27,15 +27,15 @@ func main() {
 		go proxy.StartMysql(proxyConf)
 	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT)
 	go func() {
 		<-c
-		for _, db := range proxy.PostgresDBs {
-			db.Db.Close()
+		for i := range proxy.PostgresDBs {
+			proxy.PostgresDBs[i].Close()
 		}
-		for _, db := range proxy.MysqlDBs {
-			db.Db.Close()
+		for i := range proxy.MysqlDBs {
+			proxy.MysqlDBs[i].Close()
 		}
 		os.Exit(1)
 	}()
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"container/list"
 	"context"
 	"database/sql"
 	"database/sql/driver"
@@ -26,7 +27,13 @@ type MysqlConn struct {
 	status           statusFlag
 	sequence         uint8
 	parseTime        bool
-	reset            bool // set when the Go SQL package calls ResetSession
+	reset            bool                     // set when the Go SQL package calls ResetSession
+	stmtCache        map[string]*list.Element // statements prepared by Prepare1, by query
+	stmtLRU          *list.List               // cached statements, most recently used first
+
+	// Settings holds the session variables the proxy set on the connection,
+	// with the expressions they were set to.
+	Settings map[string]string
 
 	// for context support (Go 1.8+)
 	watching bool
@@ -172,7 +179,7 @@ func (mc *MysqlConn) Prepare(query string) (driver.Stmt, error) {
 		return nil, driver.ErrBadConn
 	}
 
-	stmt := &mysqlStmt{
+	stmt := &MysqlStmt{
 		mc: mc,
 	}
 
@@ -193,6 +200,47 @@ func (mc *MysqlConn) Prepare(query string) (driver.Stmt, error) {
 	return stmt, err
 }
 
+// Sequence returns the sequence id of the next packet expected from the
+// server. After a relayed command failed, it is the sequence id the client
+// expects next.
+func (mc *MysqlConn) Sequence() byte {
+	return mc.sequence
+}
+
+// cachedStmt is a statement of the cache of Prepare1.
+type cachedStmt struct {
+	query string
+	stmt  *MysqlStmt
+}
+
+// Prepare1 returns a statement for query, preparing it on the first call
+// only. Up to maxCachedStmts statements stay open, the least recently used
+// one is closed to make room for a new one.
+func (mc *MysqlConn) Prepare1(query string) (*MysqlStmt, error) {
+	if e, ok := mc.stmtCache[query]; ok {
+		mc.stmtLRU.MoveToFront(e)
+		return e.Value.(*cachedStmt).stmt, nil
+	}
+	stmt, err := mc.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if mc.stmtCache == nil {
+		mc.stmtCache = make(map[string]*list.Element)
+		mc.stmtLRU = list.New()
+	}
+	if mc.stmtLRU.Len() >= maxCachedStmts {
+		oldest := mc.stmtLRU.Remove(mc.stmtLRU.Back()).(*cachedStmt)
+		delete(mc.stmtCache, oldest.query)
+		// COM_STMT_CLOSE has no response, a failure leaves the connection bad
+		if err := oldest.stmt.Close(); err != nil {
+			return nil, err
+		}
+	}
+	mc.stmtCache[query] = mc.stmtLRU.PushFront(&cachedStmt{query, stmt.(*MysqlStmt)})
+	return stmt.(*MysqlStmt), nil
+}
+
 func (mc *MysqlConn) interpolateParams(query string, args []driver.Value) (string, error) {
 	// Number of ? should be same to len(args)
 	if strings.Count(query, "?") != len(args) {
@@ -350,7 +398,7 @@ func (mc *MysqlConn) Query(query string, args []driver.Value) (driver.Rows, erro
 	return mc.query(query, args)
 }
 
-func (mc *MysqlConn) Query1(query string, dstConn *net.TCPConn) (*TextRows, error) {
+func (mc *MysqlConn) Query1(query string, dstConn io.Writer) (*TextRows, error) {
 	return mc.query1(query, nil, dstConn)
 }
 
@@ -401,7 +449,7 @@ func (mc *MysqlConn) query(query string, args []driver.Value) (*TextRows, error)
 	return nil, mc.markBadConn(err)
 }
 
-func (mc *MysqlConn) query1(query string, args []driver.Value, dstConn *net.TCPConn) (*TextRows, error) {
+func (mc *MysqlConn) query1(query string, args []driver.Value, dstConn io.Writer) (*TextRows, error) {
 	handleOk := mc.clearResult()
 
 	if mc.closed.Load() {
@@ -595,7 +643,7 @@ func (mc *MysqlConn) PrepareContext(ctx context.Context, query string) (driver.S
 	return stmt, nil
 }
 
-func (stmt *mysqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+func (stmt *MysqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
 	dargs, err := namedValueToValue(args)
 	if err != nil {
 		return nil, err
@@ -614,7 +662,7 @@ func (stmt *mysqlStmt) QueryContext(ctx context.Context, args []driver.NamedValu
 	return rows, err
 }
 
-func (stmt *mysqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+func (stmt *MysqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
 	dargs, err := namedValueToValue(args)
 	if err != nil {
 		return nil, err
@@ -81,6 +81,37 @@ func CreateConnector(dsn string) (*Connector, error) {
 	return newConnector(cfg)
 }
 
+// CreateConfigConnector returns a Connector opening connections described
+// by cfg.
+func CreateConfigConnector(cfg *Config) (*Connector, error) {
+	cfg = cfg.Clone()
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+	return newConnector(cfg)
+}
+
+// ForDatabase returns a Connector opening connections like c does, to
+// database instead.
+func (c *Connector) ForDatabase(database string) *Connector {
+	cfg := c.cfg.Clone()
+	cfg.DBName = database
+	return &Connector{cfg: cfg, encodedAttributes: c.encodedAttributes}
+}
+
+// ForUser returns a Connector opening connections like c does, logged in
+// as user instead.
+func (c *Connector) ForUser(user, password string) *Connector {
+	cfg := c.cfg.Clone()
+	cfg.User, cfg.Passwd = user, password
+	return &Connector{cfg: cfg, encodedAttributes: c.encodedAttributes}
+}
+
+// User returns the user connections are logged in as.
+func (c *Connector) User() string {
+	return c.cfg.User
+}
+
 // NewConnector returns new driver.Connector.
 func NewConnector(cfg *Config) (driver.Connector, error) {
 	cfg = cfg.Clone()
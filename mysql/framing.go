@@ -0,0 +1,238 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Command bytes inspected by the proxy, exported for use outside the driver.
+const (
+	ComQuit             = comQuit
+	ComInitDB           = comInitDB
+	ComQuery            = comQuery
+	ComPing             = comPing
+	ComChangeUser       = comChangeUser
+	ComStmtPrepare      = comStmtPrepare
+	ComStmtExecute      = comStmtExecute
+	ComStmtSendLongData = comStmtSendLongData
+	ComStmtClose        = comStmtClose
+	ComStmtReset        = comStmtReset
+	ComResetConnection  = comResetConnection
+)
+
+// Packet is a complete MySQL packet reassembled from one or more frames.
+// Payloads of maxPacketSize bytes or more are split by the sender into
+// several frames, each with its own 4-byte header and sequence id.
+type Packet struct {
+	// Sequence is the sequence id of the first frame.
+	Sequence byte
+	// Payload is the reassembled packet body without any frame headers.
+	Payload []byte
+	// Raw holds every frame exactly as it was read, headers included, so
+	// the packet can be forwarded unchanged.
+	Raw []byte
+}
+
+// Command returns the command byte of a client command packet. Command
+// packets always start a new sequence, so 0 is returned for any packet
+// that does not.
+func (pkt *Packet) Command() byte {
+	if pkt.Sequence != 0 || len(pkt.Payload) == 0 {
+		return 0
+	}
+	return pkt.Payload[0]
+}
+
+// IsSSLRequest reports whether the packet is the short handshake response a
+// client sends to ask for a TLS upgrade before authenticating.
+func (pkt *Packet) IsSSLRequest() bool {
+	if pkt.Sequence != 1 || len(pkt.Payload) != 32 {
+		return false
+	}
+	flags := clientFlag(binary.LittleEndian.Uint32(pkt.Payload[:4]))
+	return flags&clientSSL != 0
+}
+
+// IsError reports whether the packet is an ERR packet.
+func (pkt *Packet) IsError() bool {
+	return len(pkt.Payload) > 0 && pkt.Payload[0] == iERR
+}
+
+// PacketReader reads MySQL packets off a stream, reassembling multi-frame
+// payloads and checking frame sequence ids.
+type PacketReader struct {
+	r        *bufio.Reader
+	sequence byte
+}
+
+// NewPacketReader returns a PacketReader reading from r.
+func NewPacketReader(r io.Reader) *PacketReader {
+	return &PacketReader{r: bufio.NewReaderSize(r, defaultBufSize)}
+}
+
+// Sequence returns the sequence id of the last frame read.
+func (pr *PacketReader) Sequence() byte {
+	return pr.sequence
+}
+
+// Read reads raw bytes, including any already buffered, for callers that
+// stop parsing packets and relay the rest of the stream unchanged.
+func (pr *PacketReader) Read(b []byte) (int, error) {
+	return pr.r.Read(b)
+}
+
+// ReadPacket reads the next complete packet. The first frame may carry any
+// sequence id; every continuation frame must follow its predecessor.
+func (pr *PacketReader) ReadPacket() (*Packet, error) {
+	var pkt *Packet
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+			if pkt != nil && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		// packet length [24 bit]
+		pktLen := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+
+		// check packet sync [8 bit]
+		if pkt == nil {
+			pkt = &Packet{Sequence: header[3]}
+		} else if header[3] != pr.sequence+1 {
+			return nil, ErrPktSync
+		}
+		pr.sequence = header[3]
+
+		start := len(pkt.Raw)
+		pkt.Raw = append(pkt.Raw, header[:]...)
+		pkt.Raw = append(pkt.Raw, make([]byte, pktLen)...)
+		if _, err := io.ReadFull(pr.r, pkt.Raw[start+4:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		pkt.Payload = append(pkt.Payload, pkt.Raw[start+4:]...)
+
+		// a frame shorter than maxPacketSize terminates the packet, a
+		// zero-length frame terminates one that is a multiple of it
+		if pktLen < maxPacketSize {
+			return pkt, nil
+		}
+	}
+}
+
+// NewPacket returns a packet holding payload, framed with the given
+// starting sequence id.
+func NewPacket(sequence byte, payload []byte) *Packet {
+	raw, _ := frame(sequence, payload)
+	return &Packet{Sequence: sequence, Payload: payload, Raw: raw}
+}
+
+// WritePacket frames payload with the given starting sequence id, splitting
+// it into several frames if needed, and returns the sequence id of the last
+// frame written.
+func WritePacket(w io.Writer, sequence byte, payload []byte) (byte, error) {
+	buf, sequence := frame(sequence, payload)
+	_, err := w.Write(buf)
+	return sequence, err
+}
+
+// frame splits payload into frames and returns them with the sequence id of
+// the last one.
+func frame(sequence byte, payload []byte) ([]byte, byte) {
+	var buf []byte
+	for {
+		size := len(payload)
+		if size > maxPacketSize {
+			size = maxPacketSize
+		}
+		var header [4]byte
+		binary.LittleEndian.PutUint32(header[:], uint32(size))
+		header[3] = sequence
+		buf = append(buf, header[:]...)
+		buf = append(buf, payload[:size]...)
+		payload = payload[size:]
+		if size < maxPacketSize {
+			break
+		}
+		sequence++
+	}
+	return buf, sequence
+}
+
+// WriteErrorPacket writes me to w as an ERR packet with the given sequence id.
+func WriteErrorPacket(w io.Writer, sequence byte, me *MySQLError) error {
+	payload := make([]byte, 0, 9+len(me.Message))
+	payload = append(payload, iERR, byte(me.Number), byte(me.Number>>8), '#')
+	payload = append(payload, me.SQLState[:]...)
+	payload = append(payload, me.Message...)
+	_, err := WritePacket(w, sequence, payload)
+	return err
+}
+
+// Status returns the server status of the last response read.
+func (mc *MysqlConn) Status() ServerStatus {
+	return ServerStatus(mc.status)
+}
+
+// ParseHandshakeResponse returns the user name and the initial database of
+// the handshake response a client logs in with.
+func ParseHandshakeResponse(payload []byte) (user, database string) {
+	// capability flags [4 bytes], max packet size [4 bytes],
+	// character set [1 byte], filler [23 bytes]
+	if len(payload) < 32 {
+		return "", ""
+	}
+	flags := clientFlag(binary.LittleEndian.Uint32(payload[:4]))
+	user, pos := readNullTerminated(payload, 32)
+	// auth response
+	switch {
+	case pos >= len(payload):
+		return user, ""
+	case flags&clientPluginAuthLenEncClientData != 0:
+		num, _, n := readLengthEncodedInteger(payload[pos:])
+		pos += n + int(num)
+	case flags&clientSecureConn != 0:
+		pos += 1 + int(payload[pos])
+	default:
+		_, pos = readNullTerminated(payload, pos)
+	}
+	if flags&clientConnectWithDB != 0 && pos < len(payload) {
+		database, _ = readNullTerminated(payload, pos)
+	}
+	return user, database
+}
+
+// ParseChangeUser returns the user name and the database of a
+// COM_CHANGE_USER packet.
+func ParseChangeUser(payload []byte) (user, database string) {
+	user, pos := readNullTerminated(payload, 1)
+	if pos >= len(payload) {
+		return user, ""
+	}
+	// auth response, length prefixed by clients supporting secure
+	// connections, which all current clients do
+	pos += 1 + int(payload[pos])
+	if pos < len(payload) {
+		database, _ = readNullTerminated(payload, pos)
+	}
+	return user, database
+}
+
+// readNullTerminated returns the string starting at pos and the position
+// following its terminating null byte.
+func readNullTerminated(b []byte, pos int) (string, int) {
+	if pos >= len(b) {
+		return "", len(b)
+	}
+	end := bytes.IndexByte(b[pos:], 0)
+	if end < 0 {
+		return string(b[pos:]), len(b)
+	}
+	return string(b[pos : pos+end]), pos + end + 1
+}
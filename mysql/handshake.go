@@ -0,0 +1,390 @@
+package mysql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Capability flags the proxy adjusts when it runs the handshake itself.
+const (
+	ClientSSL      = uint32(clientSSL)
+	ClientCompress = uint32(clientCompress)
+)
+
+// Header bytes of the packets a server sends during authentication.
+const (
+	PacketOK         = iOK
+	PacketERR        = iERR
+	PacketAuthSwitch = iEOF
+)
+
+// Authentication methods the proxy verifies clients with and logs in to
+// servers with.
+const (
+	NativePassword      = "mysql_native_password"
+	CachingSHA2Password = "caching_sha2_password"
+)
+
+// Greeting is the initial handshake packet a server opens a connection with.
+type Greeting struct {
+	ProtocolVersion byte
+	ServerVersion   string
+	ConnectionID    uint32
+	Capabilities    uint32
+	Charset         byte
+	Status          uint16
+	// AuthData is the scramble passwords are hashed with.
+	AuthData   []byte
+	AuthPlugin string
+}
+
+// ParseGreeting reads the payload of an initial handshake packet.
+func ParseGreeting(payload []byte) (*Greeting, error) {
+	if len(payload) == 0 || payload[0] == iERR {
+		return nil, ErrMalformPkt
+	}
+	g := &Greeting{ProtocolVersion: payload[0]}
+	var pos int
+	g.ServerVersion, pos = readNullTerminated(payload, 1)
+	// connection id [4 bytes], auth-plugin-data-part-1 [8 bytes],
+	// filler [1 byte], capability flags (lower 2 bytes) [2 bytes]
+	if len(payload) < pos+15 {
+		return nil, ErrMalformPkt
+	}
+	g.ConnectionID = binary.LittleEndian.Uint32(payload[pos : pos+4])
+	g.AuthData = append([]byte(nil), payload[pos+4:pos+12]...)
+	g.Capabilities = uint32(binary.LittleEndian.Uint16(payload[pos+13 : pos+15]))
+	pos += 15
+	// character set [1 byte], status flags [2 bytes], capability flags
+	// (upper 2 bytes) [2 bytes], auth data length [1 byte], reserved [10 bytes]
+	if len(payload) < pos+16 {
+		return g, nil
+	}
+	g.Charset = payload[pos]
+	g.Status = binary.LittleEndian.Uint16(payload[pos+1 : pos+3])
+	g.Capabilities |= uint32(binary.LittleEndian.Uint16(payload[pos+3:pos+5])) << 16
+	authLen := int(payload[pos+5])
+	pos += 16
+	if g.Capabilities&uint32(clientSecureConn) != 0 {
+		// auth-plugin-data-part-2, at least 13 bytes including a null byte
+		n := authLen - 8
+		if n < 13 {
+			n = 13
+		}
+		if len(payload) < pos+n {
+			return nil, ErrMalformPkt
+		}
+		g.AuthData = append(g.AuthData, bytes.TrimRight(payload[pos:pos+n], "\x00")...)
+		pos += n
+	}
+	if g.Capabilities&uint32(clientPluginAuth) != 0 {
+		g.AuthPlugin, _ = readNullTerminated(payload, pos)
+	}
+	return g, nil
+}
+
+// Payload encodes the greeting as an initial handshake packet.
+func (g *Greeting) Payload() []byte {
+	payload := []byte{g.ProtocolVersion}
+	payload = append(payload, g.ServerVersion...)
+	payload = append(payload, 0)
+	payload = binary.LittleEndian.AppendUint32(payload, g.ConnectionID)
+	authData := g.AuthData
+	if len(authData) < 8 {
+		authData = append(authData, make([]byte, 8-len(authData))...)
+	}
+	payload = append(payload, authData[:8]...)
+	payload = append(payload, 0)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(g.Capabilities))
+	payload = append(payload, g.Charset)
+	payload = binary.LittleEndian.AppendUint16(payload, g.Status)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(g.Capabilities>>16))
+	if g.Capabilities&uint32(clientPluginAuth) != 0 {
+		payload = append(payload, byte(len(authData)+1))
+	} else {
+		payload = append(payload, 0)
+	}
+	payload = append(payload, make([]byte, 10)...)
+	if g.Capabilities&uint32(clientSecureConn) != 0 {
+		part2 := append(append([]byte(nil), authData[8:]...), 0)
+		if len(part2) < 13 {
+			part2 = append(part2, make([]byte, 13-len(part2))...)
+		}
+		payload = append(payload, part2...)
+	}
+	if g.Capabilities&uint32(clientPluginAuth) != 0 {
+		payload = append(payload, g.AuthPlugin...)
+		payload = append(payload, 0)
+	}
+	return payload
+}
+
+// HandshakeResponse is the packet a client logs in with in reply to the
+// greeting.
+type HandshakeResponse struct {
+	Capabilities  uint32
+	MaxPacketSize uint32
+	Charset       byte
+	User          string
+	AuthResponse  []byte
+	Database      string
+	AuthPlugin    string
+	// Attributes are the encoded connection attributes, without their
+	// length.
+	Attributes []byte
+}
+
+// ReadHandshakeResponse reads the payload of a handshake response. Only
+// the protocol 4.1 format current clients use is supported.
+func ReadHandshakeResponse(payload []byte) (*HandshakeResponse, error) {
+	// capability flags [4 bytes], max packet size [4 bytes],
+	// character set [1 byte], filler [23 bytes]
+	if len(payload) < 32 {
+		return nil, ErrMalformPkt
+	}
+	r := &HandshakeResponse{
+		Capabilities:  binary.LittleEndian.Uint32(payload[:4]),
+		MaxPacketSize: binary.LittleEndian.Uint32(payload[4:8]),
+		Charset:       payload[8],
+	}
+	flags := clientFlag(r.Capabilities)
+	if flags&clientProtocol41 == 0 {
+		return nil, errors.New("client does not support protocol 4.1")
+	}
+	var pos int
+	r.User, pos = readNullTerminated(payload, 32)
+	switch {
+	case pos >= len(payload):
+		return r, nil
+	case flags&clientPluginAuthLenEncClientData != 0:
+		num, _, n := readLengthEncodedInteger(payload[pos:])
+		pos += n
+		if len(payload) < pos+int(num) {
+			return nil, ErrMalformPkt
+		}
+		r.AuthResponse = payload[pos : pos+int(num)]
+		pos += int(num)
+	case flags&clientSecureConn != 0:
+		n := int(payload[pos])
+		pos++
+		if len(payload) < pos+n {
+			return nil, ErrMalformPkt
+		}
+		r.AuthResponse = payload[pos : pos+n]
+		pos += n
+	default:
+		var auth string
+		auth, pos = readNullTerminated(payload, pos)
+		r.AuthResponse = []byte(auth)
+	}
+	if flags&clientConnectWithDB != 0 {
+		r.Database, pos = readNullTerminated(payload, pos)
+	}
+	if flags&clientPluginAuth != 0 {
+		r.AuthPlugin, pos = readNullTerminated(payload, pos)
+	}
+	if flags&clientConnectAttrs != 0 && pos < len(payload) {
+		num, _, n := readLengthEncodedInteger(payload[pos:])
+		pos += n
+		if len(payload) < pos+int(num) {
+			return nil, ErrMalformPkt
+		}
+		r.Attributes = payload[pos : pos+int(num)]
+	}
+	return r, nil
+}
+
+// Payload encodes the handshake response.
+func (r *HandshakeResponse) Payload() []byte {
+	flags := clientFlag(r.Capabilities)
+	payload := binary.LittleEndian.AppendUint32(nil, r.Capabilities)
+	payload = binary.LittleEndian.AppendUint32(payload, r.MaxPacketSize)
+	payload = append(payload, r.Charset)
+	payload = append(payload, make([]byte, 23)...)
+	payload = append(payload, r.User...)
+	payload = append(payload, 0)
+	switch {
+	case flags&clientPluginAuthLenEncClientData != 0:
+		payload = appendLengthEncodedInteger(payload, uint64(len(r.AuthResponse)))
+		payload = append(payload, r.AuthResponse...)
+	case flags&clientSecureConn != 0:
+		payload = append(payload, byte(len(r.AuthResponse)))
+		payload = append(payload, r.AuthResponse...)
+	default:
+		payload = append(payload, r.AuthResponse...)
+		payload = append(payload, 0)
+	}
+	if flags&clientConnectWithDB != 0 {
+		payload = append(payload, r.Database...)
+		payload = append(payload, 0)
+	}
+	if flags&clientPluginAuth != 0 {
+		payload = append(payload, r.AuthPlugin...)
+		payload = append(payload, 0)
+	}
+	if flags&clientConnectAttrs != 0 {
+		payload = appendLengthEncodedInteger(payload, uint64(len(r.Attributes)))
+		payload = append(payload, r.Attributes...)
+	}
+	return payload
+}
+
+// NewScramble returns a random 20-byte scramble for a greeting. Its bytes
+// are printable, as some clients read it as a null-terminated string.
+func NewScramble() ([]byte, error) {
+	scramble := make([]byte, 20)
+	if _, err := rand.Read(scramble); err != nil {
+		return nil, err
+	}
+	for i, b := range scramble {
+		scramble[i] = '!' + b%('~'-'!')
+	}
+	return scramble, nil
+}
+
+// ScramblePassword returns the auth response proving password with the
+// scramble of a greeting for plugin.
+func ScramblePassword(plugin string, scramble []byte, password string) ([]byte, error) {
+	if len(scramble) < 20 {
+		return nil, ErrMalformPkt
+	}
+	switch plugin {
+	case NativePassword:
+		return scramblePassword(scramble[:20], password), nil
+	case CachingSHA2Password:
+		return scrambleSHA256Password(scramble[:20], password), nil
+	default:
+		return nil, ErrUnknownPlugin
+	}
+}
+
+// CheckScramble reports whether the auth response a client sent for plugin
+// proves password with scramble.
+func CheckScramble(plugin string, scramble, response []byte, password string) bool {
+	expected, err := ScramblePassword(plugin, scramble, password)
+	if err != nil {
+		return false
+	}
+	return len(expected) == len(response) && subtle.ConstantTimeCompare(expected, response) == 1
+}
+
+// AuthSwitchRequest returns the payload asking a client to authenticate
+// with plugin and scramble instead.
+func AuthSwitchRequest(plugin string, scramble []byte) []byte {
+	payload := append([]byte{iEOF}, plugin...)
+	payload = append(payload, 0)
+	payload = append(payload, scramble...)
+	return append(payload, 0)
+}
+
+// Payloads telling a caching_sha2_password client its scramble was
+// accepted, or that it must send its password.
+var (
+	FastAuthSuccess           = []byte{iAuthMoreData, cachingSha2PasswordFastAuthSuccess}
+	FullAuthenticationRequest = []byte{iAuthMoreData, cachingSha2PasswordPerformFullAuthentication}
+)
+
+// SSLRequest returns the payload asking the server for a TLS upgrade
+// before the handshake response is sent.
+func (r *HandshakeResponse) SSLRequest() []byte {
+	return r.Payload()[:32]
+}
+
+// ParseAuthSwitch returns the plugin and the scramble of an auth switch
+// request.
+func ParseAuthSwitch(payload []byte) (plugin string, scramble []byte) {
+	plugin, pos := readNullTerminated(payload, 1)
+	return plugin, bytes.TrimRight(payload[pos:], "\x00")
+}
+
+// Authenticate completes a login whose handshake response, hashing
+// password with scramble for plugin, was written to w, answering the
+// authentication requests of the server read from reader. Secure tells
+// whether the connection is encrypted, so that the password may be sent
+// in clear. It returns the packet ending the exchange, OK or ERR.
+func Authenticate(w io.Writer, reader *PacketReader, scramble []byte, plugin, password string, secure bool) (*Packet, error) {
+	switched := false
+	for {
+		pkt, err := reader.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if len(pkt.Payload) == 0 {
+			return nil, ErrMalformPkt
+		}
+		var response []byte
+		switch pkt.Payload[0] {
+		case iOK, iERR:
+			return pkt, nil
+		case iEOF:
+			// auth switch request, at most one
+			if switched {
+				return nil, ErrMalformPkt
+			}
+			switched = true
+			plugin, scramble = ParseAuthSwitch(pkt.Payload)
+			if response, err = ScramblePassword(plugin, scramble, password); err != nil {
+				return nil, err
+			}
+		case iAuthMoreData:
+			if plugin != CachingSHA2Password || len(pkt.Payload) != 2 {
+				return nil, ErrMalformPkt
+			}
+			switch pkt.Payload[1] {
+			case cachingSha2PasswordFastAuthSuccess:
+				continue
+			case cachingSha2PasswordPerformFullAuthentication:
+				if secure {
+					response = append([]byte(password), 0)
+				} else if response, err = PublicKeyPassword(w, reader, pkt.Sequence+1, scramble, password); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, ErrMalformPkt
+			}
+		default:
+			return nil, ErrMalformPkt
+		}
+		// answer the last packet read
+		if _, err = WritePacket(w, reader.Sequence()+1, response); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// PublicKeyPassword asks the server for its public key with sequence id
+// sequence and returns password encrypted with it, for a
+// caching_sha2_password full authentication over a plain connection.
+func PublicKeyPassword(w io.Writer, reader *PacketReader, sequence byte, scramble []byte, password string) ([]byte, error) {
+	if _, err := WritePacket(w, sequence, []byte{cachingSha2PasswordRequestPublicKey}); err != nil {
+		return nil, err
+	}
+	pkt, err := reader.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt.Payload) == 0 || pkt.Payload[0] != iAuthMoreData {
+		return nil, fmt.Errorf("unexpected response to public key request")
+	}
+	block, _ := pem.Decode(pkt.Payload[1:])
+	if block == nil {
+		return nil, fmt.Errorf("no pem data found in public key response")
+	}
+	pkix, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := pkix.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("server public key is not an RSA key")
+	}
+	return encryptPassword(password, scramble, pub)
+}
@@ -0,0 +1,31 @@
+package mysql
+
+import "testing"
+
+func TestCheckScramble(t *testing.T) {
+	scramble, err := NewScramble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plugin := range []string{NativePassword, CachingSHA2Password} {
+		response, err := ScramblePassword(plugin, scramble, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !CheckScramble(plugin, scramble, response, "secret") {
+			t.Errorf("%s: password rejected", plugin)
+		}
+		if CheckScramble(plugin, scramble, response, "guess") {
+			t.Errorf("%s: wrong password accepted", plugin)
+		}
+		if CheckScramble(plugin, scramble, response[:len(response)-1], "secret") {
+			t.Errorf("%s: truncated response accepted", plugin)
+		}
+		if CheckScramble(plugin, scramble, nil, "secret") {
+			t.Errorf("%s: empty response accepted", plugin)
+		}
+	}
+	if CheckScramble("sha256_password", scramble, []byte("secret"), "secret") {
+		t.Error("unknown plugin accepted")
+	}
+}
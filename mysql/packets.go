@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"net"
 	"strconv"
 	"time"
 )
@@ -82,7 +81,11 @@ func (mc *MysqlConn) readPacket() ([]byte, error) {
 	}
 }
 
-func (mc *MysqlConn) readPacket1(dstConn *net.TCPConn) ([]byte, error) {
+// readPacket1 reads a packet like readPacket and relays every frame to
+// dstConn. A frame is only relayed once it has been read completely, and
+// mc.sequence is only advanced once it has been relayed, so after a failure
+// it holds the sequence id the client expects next.
+func (mc *MysqlConn) readPacket1(dstConn io.Writer) ([]byte, error) {
 	var prevData []byte
 	for {
 		// read packet header
@@ -95,7 +98,8 @@ func (mc *MysqlConn) readPacket1(dstConn *net.TCPConn) ([]byte, error) {
 			mc.Close()
 			return nil, ErrInvalidConn
 		}
-		dstConn.Write(data)
+		var header [4]byte
+		copy(header[:], data)
 
 		// packet length [24 bit]
 		pktLen := int(uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16)
@@ -107,7 +111,6 @@ func (mc *MysqlConn) readPacket1(dstConn *net.TCPConn) ([]byte, error) {
 			}
 			return nil, ErrPktSync
 		}
-		mc.sequence++
 
 		// packets with length 0 terminate a previous packet which is a
 		// multiple of (2^24)-1 bytes long
@@ -118,6 +121,12 @@ func (mc *MysqlConn) readPacket1(dstConn *net.TCPConn) ([]byte, error) {
 				mc.Close()
 				return nil, ErrInvalidConn
 			}
+			if _, err = dstConn.Write(header[:]); err != nil {
+				// the rest of the response can no longer be relayed
+				mc.Close()
+				return nil, err
+			}
+			mc.sequence++
 
 			return prevData, nil
 		}
@@ -132,7 +141,15 @@ func (mc *MysqlConn) readPacket1(dstConn *net.TCPConn) ([]byte, error) {
 			mc.Close()
 			return nil, ErrInvalidConn
 		}
-		dstConn.Write(data)
+		if _, err = dstConn.Write(header[:]); err == nil {
+			_, err = dstConn.Write(data)
+		}
+		if err != nil {
+			// the rest of the response can no longer be relayed
+			mc.Close()
+			return nil, err
+		}
+		mc.sequence++
 
 		// return data if this was the last packet
 		if pktLen < maxPacketSize {
@@ -641,7 +658,7 @@ func (mc *okHandler) readResultSetHeaderPacket() (int, error) {
 	return 0, err
 }
 
-func (mc *okHandler) readResultSetHeaderPacket1(dstConn *net.TCPConn) (int, error) {
+func (mc *okHandler) readResultSetHeaderPacket1(dstConn io.Writer) (int, error) {
 	// handleOkPacket replaces both values; other cases leave the values unchanged.
 	mc.result.affectedRows = append(mc.result.affectedRows, 0)
 	mc.result.insertIds = append(mc.result.insertIds, 0)
@@ -886,7 +903,7 @@ func (mc *MysqlConn) readColumns(count int) ([]mysqlField, error) {
 	}
 }
 
-func (mc *MysqlConn) readColumns1(count int, dstConn *net.TCPConn) ([]mysqlField, error) {
+func (mc *MysqlConn) readColumns1(count int, dstConn io.Writer) ([]mysqlField, error) {
 	columns := make([]mysqlField, count)
 
 	for i := 0; ; i++ {
@@ -1075,7 +1092,7 @@ func (rows *TextRows) readRow(dest []driver.Value) error {
 	return nil
 }
 
-func (rows *TextRows) readRow1(dest []driver.Value, dstConn *net.TCPConn) error {
+func (rows *TextRows) readRow1(dest []driver.Value, dstConn io.Writer) error {
 	mc := rows.mc
 
 	if rows.rs.done {
@@ -1184,7 +1201,7 @@ func (mc *MysqlConn) readUntilEOF() error {
 	}
 }
 
-func (mc *MysqlConn) readUntilEOF1(dstConn *net.TCPConn) error {
+func (mc *MysqlConn) readUntilEOF1(dstConn io.Writer) error {
 	for {
 		data, err := mc.readPacket1(dstConn)
 		if err != nil {
@@ -1209,7 +1226,7 @@ func (mc *MysqlConn) readUntilEOF1(dstConn *net.TCPConn) error {
 
 // Prepare Result Packets
 // http://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html
-func (stmt *mysqlStmt) readPrepareResultPacket() (uint16, error) {
+func (stmt *MysqlStmt) readPrepareResultPacket() (uint16, error) {
 	data, err := stmt.mc.readPacket()
 	if err == nil {
 		// packet indicator [1 byte]
@@ -1236,7 +1253,7 @@ func (stmt *mysqlStmt) readPrepareResultPacket() (uint16, error) {
 }
 
 // http://dev.mysql.com/doc/internals/en/com-stmt-send-long-data.html
-func (stmt *mysqlStmt) writeCommandLongData(paramID int, arg []byte) error {
+func (stmt *MysqlStmt) writeCommandLongData(paramID int, arg []byte) error {
 	maxLen := stmt.mc.maxAllowedPacket - 1
 	pktLen := maxLen
 
@@ -1289,7 +1306,7 @@ func (stmt *mysqlStmt) writeCommandLongData(paramID int, arg []byte) error {
 
 // Execute Prepared Statement
 // http://dev.mysql.com/doc/internals/en/com-stmt-execute.html
-func (stmt *mysqlStmt) writeExecutePacket(args []driver.Value) error {
+func (stmt *MysqlStmt) writeExecutePacket(args []driver.Value) error {
 	if len(args) != stmt.paramCount {
 		return fmt.Errorf(
 			"argument count mismatch (got: %d; has: %d)",
@@ -1732,3 +1749,31 @@ func (rows *BinaryRows) readRow(dest []driver.Value) error {
 
 	return nil
 }
+
+// readRow1 relays the next binary row to dstConn without decoding it.
+func (rows *BinaryRows) readRow1(dstConn io.Writer) error {
+	data, err := rows.mc.readPacket1(dstConn)
+	if err != nil {
+		return err
+	}
+
+	// packet indicator [1 byte]
+	if data[0] != iOK {
+		// EOF Packet
+		if data[0] == iEOF && len(data) == 5 {
+			rows.mc.status = readStatus(data[3:])
+			rows.rs.done = true
+			if !rows.HasNextResultSet() {
+				rows.mc = nil
+			}
+			return io.EOF
+		}
+		mc := rows.mc
+		rows.mc = nil
+
+		// Error otherwise
+		return mc.handleErrorPacket(data)
+	}
+
+	return nil
+}
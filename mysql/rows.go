@@ -4,7 +4,6 @@ import (
 	"database/sql/driver"
 	"io"
 	"math"
-	"net"
 	"reflect"
 )
 
@@ -159,7 +158,7 @@ func (rows *MysqlRows) nextResultSet() (int, error) {
 	return rows.mc.resultUnchanged().readResultSetHeaderPacket()
 }
 
-func (rows *MysqlRows) nextResultSet1(dstConn *net.TCPConn) (int, error) {
+func (rows *MysqlRows) nextResultSet1(dstConn io.Writer) (int, error) {
 	if rows.mc == nil {
 		return 0, io.EOF
 	}
@@ -200,7 +199,7 @@ func (rows *MysqlRows) nextNotEmptyResultSet() (int, error) {
 	}
 }
 
-func (rows *MysqlRows) nextNotEmptyResultSet1(dstConn *net.TCPConn) (int, error) {
+func (rows *MysqlRows) nextNotEmptyResultSet1(dstConn io.Writer) (int, error) {
 	for {
 		resLen, err := rows.nextResultSet1(dstConn)
 		if err != nil {
@@ -225,7 +224,7 @@ func (rows *BinaryRows) NextResultSet() error {
 	return err
 }
 
-func (rows *BinaryRows) NextResultSet1(dstConn *net.TCPConn) error {
+func (rows *BinaryRows) NextResultSet1(dstConn io.Writer) error {
 	resLen, err := rows.nextNotEmptyResultSet1(dstConn)
 	if err != nil {
 		return err
@@ -247,6 +246,18 @@ func (rows *BinaryRows) Next(dest []driver.Value) error {
 	return io.EOF
 }
 
+func (rows *BinaryRows) Next1(dstConn io.Writer) error {
+	if mc := rows.mc; mc != nil {
+		if err := mc.error(); err != nil {
+			return err
+		}
+
+		// Relay next row from stream
+		return rows.readRow1(dstConn)
+	}
+	return io.EOF
+}
+
 func (rows *TextRows) NextResultSet() (err error) {
 	resLen, err := rows.nextNotEmptyResultSet()
 	if err != nil {
@@ -257,7 +268,7 @@ func (rows *TextRows) NextResultSet() (err error) {
 	return err
 }
 
-func (rows *TextRows) NextResultSet1(dstConn *net.TCPConn) (err error) {
+func (rows *TextRows) NextResultSet1(dstConn io.Writer) (err error) {
 	resLen, err := rows.nextNotEmptyResultSet1(dstConn)
 	if err != nil {
 		return err
@@ -279,7 +290,7 @@ func (rows *TextRows) Next(dest []driver.Value) error {
 	return io.EOF
 }
 
-func (rows *TextRows) Next1(dest []driver.Value, dstConn *net.TCPConn) error {
+func (rows *TextRows) Next1(dest []driver.Value, dstConn io.Writer) error {
 	if mc := rows.mc; mc != nil {
 		if err := mc.error(); err != nil {
 			return err
@@ -0,0 +1,37 @@
+package mysql
+
+import (
+	"strings"
+)
+
+// ResetSettings sets the session variables in Settings back to their
+// defaults, and the character set back to the one the connection was
+// opened with if it was changed.
+func (mc *MysqlConn) ResetSettings() error {
+	if len(mc.Settings) == 0 {
+		return nil
+	}
+	var items []string
+	for name := range mc.Settings {
+		switch name {
+		case "names", "character set":
+			continue
+		}
+		items = append(items, "SESSION "+name+" = DEFAULT")
+	}
+	_, names := mc.Settings["names"]
+	_, charset := mc.Settings["character set"]
+	if names || charset {
+		collation := mc.cfg.Collation
+		if collation == "" {
+			collation = defaultCollation
+		}
+		cs, _, _ := strings.Cut(collation, "_")
+		items = append(items, "NAMES "+cs+" COLLATE "+collation)
+	}
+	if err := mc.exec("SET " + strings.Join(items, ", ")); err != nil {
+		return err
+	}
+	mc.Settings = nil
+	return nil
+}
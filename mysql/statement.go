@@ -2,19 +2,20 @@ package mysql
 
 import (
 	"database/sql/driver"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"reflect"
 )
 
-type mysqlStmt struct {
+type MysqlStmt struct {
 	mc         *MysqlConn
 	id         uint32
 	paramCount int
 }
 
-func (stmt *mysqlStmt) Close() error {
+func (stmt *MysqlStmt) Close() error {
 	if stmt.mc == nil || stmt.mc.closed.Load() {
 		// driver.Stmt.Close can be called more than once, thus this function
 		// has to be idempotent.
@@ -28,20 +29,20 @@ func (stmt *mysqlStmt) Close() error {
 	return err
 }
 
-func (stmt *mysqlStmt) NumInput() int {
+func (stmt *MysqlStmt) NumInput() int {
 	return stmt.paramCount
 }
 
-func (stmt *mysqlStmt) ColumnConverter(idx int) driver.ValueConverter {
+func (stmt *MysqlStmt) ColumnConverter(idx int) driver.ValueConverter {
 	return converter{}
 }
 
-func (stmt *mysqlStmt) CheckNamedValue(nv *driver.NamedValue) (err error) {
+func (stmt *MysqlStmt) CheckNamedValue(nv *driver.NamedValue) (err error) {
 	nv.Value, err = converter{}.ConvertValue(nv.Value)
 	return
 }
 
-func (stmt *mysqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+func (stmt *MysqlStmt) Exec(args []driver.Value) (driver.Result, error) {
 	if stmt.mc.closed.Load() {
 		stmt.mc.cfg.Logger.Print(ErrInvalidConn)
 		return nil, driver.ErrBadConn
@@ -81,11 +82,11 @@ func (stmt *mysqlStmt) Exec(args []driver.Value) (driver.Result, error) {
 	return &copied, nil
 }
 
-func (stmt *mysqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+func (stmt *MysqlStmt) Query(args []driver.Value) (driver.Rows, error) {
 	return stmt.query(args)
 }
 
-func (stmt *mysqlStmt) query(args []driver.Value) (*BinaryRows, error) {
+func (stmt *MysqlStmt) query(args []driver.Value) (*BinaryRows, error) {
 	if stmt.mc.closed.Load() {
 		stmt.mc.cfg.Logger.Print(ErrInvalidConn)
 		return nil, driver.ErrBadConn
@@ -124,6 +125,61 @@ func (stmt *mysqlStmt) query(args []driver.Value) (*BinaryRows, error) {
 	return rows, err
 }
 
+// ID returns the statement id assigned by the server.
+func (stmt *MysqlStmt) ID() uint32 {
+	return stmt.id
+}
+
+// Query1 executes the statement with a COM_STMT_EXECUTE payload received
+// from a client, whose statement id is replaced by this statement's, and
+// relays the response to dstConn.
+func (stmt *MysqlStmt) Query1(payload []byte, dstConn io.Writer) (*BinaryRows, error) {
+	if stmt.mc.closed.Load() {
+		stmt.mc.cfg.Logger.Print(ErrInvalidConn)
+		return nil, driver.ErrBadConn
+	}
+	mc := stmt.mc
+
+	// Send command
+	mc.sequence = 0
+	data, err := mc.buf.takeBuffer(4 + len(payload))
+	if err != nil {
+		// cannot take the buffer. Something must be wrong with the connection
+		mc.cfg.Logger.Print(err)
+		return nil, driver.ErrBadConn
+	}
+	copy(data[4:], payload)
+	binary.LittleEndian.PutUint32(data[5:9], stmt.id)
+	if err = mc.writePacket(data); err != nil {
+		return nil, mc.markBadConn(err)
+	}
+
+	// Read Result
+	handleOk := mc.clearResult()
+	resLen, err := handleOk.readResultSetHeaderPacket1(dstConn)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := new(BinaryRows)
+
+	if resLen > 0 {
+		rows.mc = mc
+		rows.rs.columns, err = mc.readColumns1(resLen, dstConn)
+	} else {
+		rows.rs.done = true
+
+		switch err := rows.NextResultSet1(dstConn); err {
+		case nil, io.EOF:
+			return rows, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return rows, err
+}
+
 var jsonType = reflect.TypeOf(json.RawMessage{})
 
 type converter struct{}
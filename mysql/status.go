@@ -0,0 +1,431 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// ServerStatus holds the status flags a server reports in OK and EOF packets.
+type ServerStatus uint16
+
+// InTrans reports whether a transaction is open on the session.
+func (s ServerStatus) InTrans() bool {
+	return statusFlag(s)&(statusInTrans|statusInTransReadonly) != 0
+}
+
+// InReadOnlyTrans reports whether the open transaction is read-only.
+func (s ServerStatus) InReadOnlyTrans() bool {
+	return statusFlag(s)&statusInTransReadonly != 0
+}
+
+// Autocommit reports whether statements outside a transaction are committed
+// as they complete. Without it, the next statement opens a transaction.
+func (s ServerStatus) Autocommit() bool {
+	return statusFlag(s)&statusInAutocommit != 0
+}
+
+// sessionTrackGTIDs is the type of the session state change reporting the
+// GTIDs of the transactions the session committed.
+const sessionTrackGTIDs = 3
+
+// response parsing states of StatusTracker
+const (
+	trackGreeting = iota
+	trackAuth
+	trackIdle
+	trackResult
+	trackColumns
+	trackColumnsEOF
+	trackRows
+	trackPrepare
+	trackPrepareDefs
+	trackFieldList
+	trackSingle
+	trackLost
+)
+
+// StatusTracker follows the conversation between a client and a server to
+// find the OK and EOF packets that carry the server status. Commands are
+// reported as they are sent to the server, responses as they are read, in
+// any goroutines.
+type StatusTracker struct {
+	mu sync.Mutex
+
+	serverFlags  clientFlag
+	clientFlags  clientFlag
+	deprecateEOF bool
+
+	// commands sent to the server and not answered yet
+	commands []byte
+	state    int
+	// defs counts the column or parameter definitions still to come,
+	// prepareColumns the column definitions following the parameter ones
+	// of a prepared statement.
+	defs           int
+	prepareColumns int
+	status         ServerStatus
+	// gtids is the last GTID set reported in the session state changes
+	gtids string
+	// answered counts the commands answered, sent those sent, failed is set
+	// while reading an ERR packet.
+	answered, sent uint64
+	failed         bool
+	// selects holds the databases commands not answered yet select, by the
+	// number of the command, nextSelect that of the next command.
+	selects    []databaseSelect
+	nextSelect *string
+	database   string
+	selected   bool
+}
+
+// databaseSelect is a database a command selects, once the server accepts it.
+type databaseSelect struct {
+	command  uint64
+	database string
+}
+
+// NewStatusTracker returns a StatusTracker for a connection that has not
+// received the server greeting yet.
+func NewStatusTracker() *StatusTracker {
+	return &StatusTracker{
+		state:  trackGreeting,
+		status: ServerStatus(statusInAutocommit),
+	}
+}
+
+// Status returns the status of the last response that reported one.
+func (st *StatusTracker) Status() ServerStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.status
+}
+
+// SessionTrack reports whether client and server agreed on reporting
+// session state changes in OK packets.
+func (st *StatusTracker) SessionTrack() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.serverFlags&st.clientFlags&clientSessionTrack != 0
+}
+
+// GTIDs returns the GTID set the server last reported for the transactions
+// of the session, if it tracks them as session_track_gtids is set.
+func (st *StatusTracker) GTIDs() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.gtids
+}
+
+// Pending reports whether commands were sent to the server that it has not
+// answered yet, so that the status may be about to change.
+func (st *StatusTracker) Pending() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.commands) > 0
+}
+
+// SelectsDatabase records that the next command passed to Command selects
+// database, as COM_INIT_DB, USE or COM_CHANGE_USER do.
+func (st *StatusTracker) SelectsDatabase(database string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nextSelect = &database
+}
+
+// Database returns the database selected by the last command the server
+// accepted among those reported with SelectsDatabase, if any was.
+func (st *StatusTracker) Database() (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.database, st.selected
+}
+
+// Preparing reports whether the next packet read from the server starts
+// the response to a COM_STMT_PREPARE.
+func (st *StatusTracker) Preparing() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.state == trackPrepare
+}
+
+// Command records a packet sent by the client to the server.
+func (st *StatusTracker) Command(pkt *Packet) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	selects := st.nextSelect
+	st.nextSelect = nil
+	if st.state == trackAuth && pkt.Sequence == 1 && len(pkt.Payload) >= 4 && st.clientFlags == 0 {
+		// handshake response
+		st.clientFlags = clientFlag(binary.LittleEndian.Uint32(pkt.Payload[:4]))
+		st.deprecateEOF = st.serverFlags&st.clientFlags&clientDeprecateEOF != 0
+		return
+	}
+	switch pkt.Command() {
+	case 0, comQuit, comStmtClose, comStmtSendLongData:
+		// data for a command in progress, or a command without response
+		return
+	case comBinlogDump, comRegisterSlave:
+		// the connection turns into a replication stream
+		st.state = trackLost
+		return
+	}
+	st.commands = append(st.commands, pkt.Command())
+	st.sent++
+	if selects != nil {
+		st.selects = append(st.selects, databaseSelect{st.sent, *selects})
+	}
+	if st.state == trackIdle {
+		st.next()
+	}
+}
+
+// next starts reading the response to the oldest command not answered yet.
+func (st *StatusTracker) next() {
+	if len(st.commands) == 0 {
+		st.state = trackIdle
+		return
+	}
+	switch st.commands[0] {
+	case comQuery, comStmtExecute, comProcessInfo:
+		st.state = trackResult
+	case comStmtFetch:
+		st.state = trackRows
+	case comFieldList:
+		st.state = trackFieldList
+	case comStmtPrepare:
+		st.state = trackPrepare
+	case comChangeUser:
+		st.state = trackAuth
+	default:
+		st.state = trackSingle
+	}
+}
+
+// done ends the response to the oldest command.
+func (st *StatusTracker) done() {
+	if len(st.commands) > 0 {
+		st.commands = st.commands[1:]
+		st.answered++
+		if len(st.selects) > 0 && st.selects[0].command == st.answered {
+			if !st.failed {
+				st.database, st.selected = st.selects[0].database, true
+			}
+			st.selects = st.selects[1:]
+		}
+	}
+	st.next()
+}
+
+// Response records a packet sent by the server to the client, reporting
+// whether it ends a successful authentication.
+func (st *StatusTracker) Response(pkt *Packet) (authenticated bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data := pkt.Payload
+	if len(data) == 0 {
+		return
+	}
+	st.failed = data[0] == iERR
+	switch st.state {
+	case trackGreeting:
+		st.readGreeting(data)
+		st.state = trackAuth
+	case trackAuth:
+		switch data[0] {
+		case iOK:
+			st.readOK(data)
+			st.done()
+			authenticated = true
+		case iERR:
+			st.done()
+		}
+	case trackResult:
+		switch data[0] {
+		case iOK:
+			st.readOK(data)
+			st.endResult()
+		case iERR:
+			st.done()
+		case iLocalInFile:
+			// the client sends the file, then the server answers with OK
+		default:
+			num, _, _ := readLengthEncodedInteger(data)
+			st.defs = int(num)
+			st.state = trackColumns
+		}
+	case trackColumns:
+		st.defs--
+		if st.defs > 0 {
+			return
+		}
+		if st.deprecateEOF {
+			st.state = trackRows
+		} else {
+			st.state = trackColumnsEOF
+		}
+	case trackColumnsEOF:
+		st.readEOF(data)
+		if statusFlag(st.status)&statusCursorExists != 0 {
+			// rows are fetched with COM_STMT_FETCH
+			st.done()
+			return
+		}
+		st.state = trackRows
+	case trackRows:
+		switch {
+		case data[0] == iERR:
+			st.done()
+		case data[0] == iEOF && len(data) < maxPacketSize:
+			if st.deprecateEOF {
+				st.readOK(data)
+			} else {
+				st.readEOF(data)
+			}
+			st.endResult()
+		}
+	case trackPrepare:
+		if data[0] != iOK || len(data) < 9 {
+			st.done()
+			return
+		}
+		// the parameter and column definitions of the statement follow
+		st.state = trackPrepareDefs
+		st.defs = int(binary.LittleEndian.Uint16(data[7:9]))
+		st.prepareColumns = int(binary.LittleEndian.Uint16(data[5:7]))
+		if st.defs == 0 {
+			st.nextPrepareDefs()
+		}
+	case trackPrepareDefs:
+		if st.defs > 0 {
+			st.defs--
+			if st.defs == 0 && st.deprecateEOF {
+				st.nextPrepareDefs()
+			}
+			return
+		}
+		st.readEOF(data)
+		st.nextPrepareDefs()
+	case trackFieldList:
+		switch {
+		case data[0] == iERR:
+			st.done()
+		case data[0] == iEOF && len(data) < 9:
+			st.readEOF(data)
+			st.done()
+		}
+	case trackSingle:
+		switch data[0] {
+		case iOK:
+			st.readOK(data)
+		case iEOF:
+			st.readEOF(data)
+		}
+		st.done()
+	}
+	return
+}
+
+// nextPrepareDefs moves from the parameter definitions of a prepared
+// statement to its column definitions, or ends the response.
+func (st *StatusTracker) nextPrepareDefs() {
+	if st.prepareColumns < 0 {
+		st.done()
+		return
+	}
+	st.defs = st.prepareColumns
+	st.prepareColumns = -1
+	if st.defs == 0 {
+		st.done()
+	}
+}
+
+// endResult ends a result set, which may be followed by another one.
+func (st *StatusTracker) endResult() {
+	if statusFlag(st.status)&statusMoreResultsExists != 0 {
+		st.state = trackResult
+		return
+	}
+	st.done()
+}
+
+func (st *StatusTracker) readGreeting(data []byte) {
+	// protocol version [1 byte], server version [null terminated string],
+	// connection id [4 bytes], auth-plugin-data-part-1 [8 bytes], filler [1 byte]
+	pos := 1
+	for pos < len(data) && data[pos] != 0 {
+		pos++
+	}
+	pos += 1 + 4 + 8 + 1
+	if len(data) < pos+2 {
+		return
+	}
+	// capability flags (lower 2 bytes) [2 bytes]
+	st.serverFlags = clientFlag(binary.LittleEndian.Uint16(data[pos : pos+2]))
+	pos += 2
+	// character set [1 byte], status flags [2 bytes],
+	// capability flags (upper 2 bytes) [2 bytes]
+	if len(data) >= pos+5 {
+		st.status = ServerStatus(binary.LittleEndian.Uint16(data[pos+1 : pos+3]))
+		st.serverFlags |= clientFlag(binary.LittleEndian.Uint16(data[pos+3:pos+5])) << 16
+	}
+}
+
+func (st *StatusTracker) readOK(data []byte) {
+	// header [1 byte], affected rows [length encoded integer],
+	// last insert id [length encoded integer], status flags [2 bytes]
+	_, _, n := readLengthEncodedInteger(data[1:])
+	pos := 1 + n
+	if pos >= len(data) {
+		return
+	}
+	_, _, n = readLengthEncodedInteger(data[pos:])
+	pos += n
+	if len(data) < pos+2 {
+		return
+	}
+	st.status = ServerStatus(binary.LittleEndian.Uint16(data[pos : pos+2]))
+	if st.serverFlags&st.clientFlags&clientSessionTrack == 0 ||
+		statusFlag(st.status)&statusSessionStateChanged == 0 {
+		return
+	}
+	// warnings [2 bytes], info [length encoded string],
+	// session state changes [length encoded string]
+	pos += 4
+	if pos >= len(data) {
+		return
+	}
+	n, err := skipLengthEncodedString(data[pos:])
+	pos += n
+	if err != nil || pos >= len(data) {
+		return
+	}
+	changes, _, _, err := readLengthEncodedString(data[pos:])
+	if err == nil {
+		st.readSessionState(changes)
+	}
+}
+
+func (st *StatusTracker) readSessionState(changes []byte) {
+	// type [1 byte], data [length encoded string], repeated
+	for len(changes) > 1 {
+		value, _, n, err := readLengthEncodedString(changes[1:])
+		if err != nil {
+			return
+		}
+		if changes[0] == sessionTrackGTIDs && len(value) > 1 {
+			// encoding specification [1 byte], GTID set [length encoded string]
+			gtids, _, _, err := readLengthEncodedString(value[1:])
+			if err == nil && len(gtids) > 0 {
+				st.gtids = string(gtids)
+			}
+		}
+		changes = changes[1+n:]
+	}
+}
+
+func (st *StatusTracker) readEOF(data []byte) {
+	// header [1 byte], warnings [2 bytes], status flags [2 bytes]
+	if data[0] == iEOF && len(data) >= 5 {
+		st.status = ServerStatus(binary.LittleEndian.Uint16(data[3:5]))
+	}
+}
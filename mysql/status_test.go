@@ -0,0 +1,183 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// trackedSession returns a StatusTracker past the authentication of a
+// session where client and server agreed on flags.
+func trackedSession(flags clientFlag) *StatusTracker {
+	st := NewStatusTracker()
+	greeting := append([]byte{10}, "8.0.36\x00"...)
+	greeting = append(greeting, make([]byte, 4+8+1)...)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(flags))
+	greeting = append(greeting, 255)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(statusInAutocommit))
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(flags>>16))
+	st.Response(packet(0, greeting))
+	handshake := binary.LittleEndian.AppendUint32(nil, uint32(flags))
+	st.Command(packet(1, append(handshake, make([]byte, 28)...)))
+	st.Response(packet(2, okPacket(statusInAutocommit)))
+	return st
+}
+
+func packet(sequence byte, payload []byte) *Packet {
+	return &Packet{Sequence: sequence, Payload: payload}
+}
+
+func okPacket(status statusFlag) []byte {
+	data := []byte{iOK, 0, 0}
+	data = binary.LittleEndian.AppendUint16(data, uint16(status))
+	return append(data, 0, 0)
+}
+
+func eofPacket(status statusFlag) []byte {
+	return binary.LittleEndian.AppendUint16([]byte{iEOF, 0, 0}, uint16(status))
+}
+
+// gtidPacket is an OK packet reporting gtids in its session state changes.
+func gtidPacket(gtids string) []byte {
+	data := okPacket(statusInAutocommit | statusSessionStateChanged)
+	value := append([]byte{0, byte(len(gtids))}, gtids...)
+	changes := append([]byte{sessionTrackGTIDs, byte(len(value))}, value...)
+	data = append(data, 0)
+	return append(append(data, byte(len(changes))), changes...)
+}
+
+// trackedPacket is a packet sent by the client, or by the server if
+// response is set.
+type trackedPacket struct {
+	response bool
+	data     []byte
+}
+
+func command(data []byte) trackedPacket  { return trackedPacket{false, data} }
+func response(data []byte) trackedPacket { return trackedPacket{true, data} }
+
+func TestStatusTracker(t *testing.T) {
+	query := []byte{comQuery, 'S', 'E', 'L', 'E', 'C', 'T', ' ', '1'}
+	begin := []byte{comQuery, 'B', 'E', 'G', 'I', 'N'}
+	prepare := []byte{comStmtPrepare, 'S', 'E', 'L', 'E', 'C', 'T', ' ', '?'}
+	// statement id [4 bytes], 1 column, 1 parameter, filler, no warnings
+	prepareOK := []byte{iOK, 1, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}
+	initDB := []byte{comInitDB, 's', 'h', 'o', 'p'}
+	inTrans := statusInTrans | statusInAutocommit
+
+	tests := []struct {
+		name    string
+		flags   clientFlag
+		packets []trackedPacket
+		inTrans bool
+		pending bool
+		gtids   string
+		// selects is the database the first command selects, database
+		// the one selected at the end
+		selects  string
+		database string
+	}{
+		{
+			name:    "BEGIN answered",
+			packets: []trackedPacket{command(begin), response(okPacket(inTrans))},
+			inTrans: true,
+		},
+		{
+			name:    "BEGIN pipelined",
+			packets: []trackedPacket{command(begin)},
+			pending: true,
+		},
+		{
+			name:    "BEGIN and SELECT pipelined, BEGIN answered",
+			packets: []trackedPacket{command(begin), command(query), response(okPacket(inTrans))},
+			inTrans: true,
+			pending: true,
+		},
+		{
+			name: "result set",
+			packets: []trackedPacket{
+				command(query), response([]byte{1}), response([]byte("def")), response(eofPacket(inTrans)),
+				response([]byte{1, '1'}), response(eofPacket(inTrans)),
+			},
+			inTrans: true,
+		},
+		{
+			name:  "result set without EOF",
+			flags: clientDeprecateEOF,
+			packets: []trackedPacket{
+				command(query), response([]byte{1}), response([]byte("def")),
+				response([]byte{1, '1'}), response(append([]byte{iEOF}, okPacket(inTrans)[1:]...)),
+			},
+			inTrans: true,
+		},
+		{
+			name:    "error",
+			packets: []trackedPacket{command(query), response([]byte{iERR, 0x28, 0x04})},
+		},
+		{
+			name: "prepare",
+			packets: []trackedPacket{
+				command(prepare), response(prepareOK), response([]byte("def")), response(eofPacket(inTrans)),
+				response([]byte("def")), response(eofPacket(inTrans)),
+			},
+			inTrans: true,
+		},
+		{
+			name:    "commands without response",
+			packets: []trackedPacket{command([]byte{comStmtClose, 1, 0, 0, 0}), command([]byte{comStmtSendLongData, 1, 0, 0, 0, 0, 0})},
+		},
+		{
+			name:    "GTIDs tracked",
+			flags:   clientSessionTrack,
+			packets: []trackedPacket{command(query), response(gtidPacket("3e11fa47-71ca-11e1-9e33-c80aa9429562:23"))},
+			gtids:   "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+		},
+		{
+			name:     "database accepted",
+			packets:  []trackedPacket{command(initDB), response(okPacket(statusInAutocommit))},
+			selects:  "shop",
+			database: "shop",
+		},
+		{
+			name:    "database rejected",
+			packets: []trackedPacket{command(initDB), response([]byte{iERR, 0x19, 0x04})},
+			selects: "shop",
+		},
+		{
+			name:    "database pipelined",
+			packets: []trackedPacket{command(initDB), command(query)},
+			selects: "shop",
+			pending: true,
+		},
+		{
+			name:    "GTIDs not tracked",
+			packets: []trackedPacket{command(query), response(gtidPacket("3e11fa47-71ca-11e1-9e33-c80aa9429562:23"))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := trackedSession(tt.flags | clientProtocol41)
+			if tt.selects != "" {
+				st.SelectsDatabase(tt.selects)
+			}
+			for i, pkt := range tt.packets {
+				if pkt.response {
+					st.Response(packet(byte(i+1), pkt.data))
+				} else {
+					st.Command(packet(0, pkt.data))
+				}
+			}
+			if got := st.Status().InTrans(); got != tt.inTrans {
+				t.Errorf("InTrans() = %v, want %v", got, tt.inTrans)
+			}
+			if got := st.Pending(); got != tt.pending {
+				t.Errorf("Pending() = %v, want %v", got, tt.pending)
+			}
+			if got := st.GTIDs(); got != tt.gtids {
+				t.Errorf("GTIDs() = %q, want %q", got, tt.gtids)
+			}
+			if got, ok := st.Database(); got != tt.database || ok != (tt.database != "") {
+				t.Errorf("Database() = %q, %v, want %q", got, ok, tt.database)
+			}
+		})
+	}
+}
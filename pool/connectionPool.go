@@ -82,10 +82,13 @@ func (cp *ConnectionPool) Get() (*mysql.MysqlConn, error) {
 
 // Put returns a connection to the pool
 func (cp *ConnectionPool) Put(conn *mysql.MysqlConn) {
+	// the next user starts from the default session settings
+	err := conn.ResetSettings()
+
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 
-	if cp.closed {
+	if cp.closed || err != nil || !conn.IsValid() {
 		_ = conn.Close()
 		return
 	}
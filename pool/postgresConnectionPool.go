@@ -0,0 +1,140 @@
+package pool
+
+import (
+	"context"
+	"dbrwproxy/postgres"
+	"errors"
+	"sync"
+	"time"
+)
+
+// PostgresConnectionPool manages a pool of PostgreSQL connections
+type PostgresConnectionPool struct {
+	mu           sync.Mutex
+	connector    *postgres.Connector
+	conns        chan *postgres.PostgresConn
+	minConns     int
+	maxConns     int
+	idleTimeout  time.Duration
+	closed       bool
+	closeChannel chan bool
+}
+
+// NewPostgresConnectionPool creates a new PostgreSQL connection pool
+func NewPostgresConnectionPool(connector *postgres.Connector, minConns, maxConns int, idleTimeout time.Duration) *PostgresConnectionPool {
+	return &PostgresConnectionPool{
+		conns:        make(chan *postgres.PostgresConn, maxConns),
+		connector:    connector,
+		minConns:     minConns,
+		maxConns:     maxConns,
+		idleTimeout:  idleTimeout,
+		closeChannel: make(chan bool),
+	}
+}
+
+// Open initializes the connection pool
+func (cp *PostgresConnectionPool) Open() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.closed {
+		return errors.New("connection pool is closed")
+	}
+
+	// initialize the specified minimum number of connections
+	for i := 0; i < cp.minConns; i++ {
+		conn, err := cp.connector.Connect(context.Background())
+		if err != nil {
+			return err
+		}
+		cp.conns <- conn
+	}
+
+	// start a goroutine to clean up idle connections
+	go cp.reapIdleConns()
+
+	return nil
+}
+
+// Get gets an available connection from the pool
+func (cp *PostgresConnectionPool) Get() (*postgres.PostgresConn, error) {
+	cp.mu.Lock()
+
+	if cp.closed {
+		cp.mu.Unlock()
+		return nil, errors.New("connection pool is closed")
+	}
+
+	// get connection from pool, or create a new one if pool is empty
+	select {
+	case db := <-cp.conns:
+		cp.mu.Unlock()
+		return db, nil
+	default:
+		conn, err := cp.connector.Connect(context.Background())
+		cp.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// Put returns a connection to the pool
+func (cp *PostgresConnectionPool) Put(conn *postgres.PostgresConn) {
+	// the next user starts from the default session settings
+	err := conn.ResetSettings()
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.closed || err != nil || !conn.IsValid() {
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case cp.conns <- conn:
+		// connection returned to pool
+	default:
+		// pool already full, close connection
+		_ = conn.Close()
+	}
+}
+
+// Close closes the connection pool
+func (cp *PostgresConnectionPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.closed {
+		return
+	}
+
+	cp.closed = true
+	close(cp.closeChannel)
+
+	for i := 0; i < len(cp.conns); i++ {
+		conn := <-cp.conns
+		_ = conn.Close()
+	}
+}
+
+// reapIdleConns periodically closes idle connections
+func (cp *PostgresConnectionPool) reapIdleConns() {
+	for {
+		select {
+		case <-cp.closeChannel:
+			return
+		case <-time.After(cp.idleTimeout):
+			// close idle connections
+			cp.mu.Lock()
+			idleConns := len(cp.conns) - cp.minConns
+			cp.mu.Unlock()
+			for i := 0; i < idleConns; i++ {
+				conn := <-cp.conns
+				_ = conn.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package postgres
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"strconv"
+	"strings"
+)
+
+const scramSHA256 = "SCRAM-SHA-256"
+
+// Authenticate answers the authentication requests the server sends on
+// frontend as user until it accepts or rejects the connection.
+func Authenticate(frontend *pgproto3.Frontend, user, password string) error {
+	for {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.AuthenticationOk:
+			return nil
+		case *pgproto3.AuthenticationCleartextPassword:
+			err = send(frontend, &pgproto3.PasswordMessage{Password: password})
+		case *pgproto3.AuthenticationMD5Password:
+			err = send(frontend, &pgproto3.PasswordMessage{Password: MD5Password(user, password, msg.Salt)})
+		case *pgproto3.AuthenticationSASL:
+			err = scramAuth(frontend, msg.AuthMechanisms, password)
+		case *pgproto3.ErrorResponse:
+			return ErrorFromResponse(msg)
+		default:
+			return fmt.Errorf("unsupported authentication message %T", msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// MD5Password returns the response to an md5 password challenge.
+func MD5Password(user, password string, salt [4]byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt[:]...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+func send(frontend *pgproto3.Frontend, msg pgproto3.FrontendMessage) error {
+	frontend.Send(msg)
+	return frontend.Flush()
+}
+
+func scramAuth(frontend *pgproto3.Frontend, mechanisms []string, password string) error {
+	supported := false
+	for _, mechanism := range mechanisms {
+		if mechanism == scramSHA256 {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("unsupported SASL mechanisms %v", mechanisms)
+	}
+
+	clientNonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	clientFirstBare := "n=,r=" + clientNonce
+	err = send(frontend, &pgproto3.SASLInitialResponse{AuthMechanism: scramSHA256, Data: []byte("n,," + clientFirstBare)})
+	if err != nil {
+		return err
+	}
+
+	msg, err := frontend.Receive()
+	if err != nil {
+		return err
+	}
+	cont, ok := msg.(*pgproto3.AuthenticationSASLContinue)
+	if !ok {
+		return unexpectedMessage(msg)
+	}
+	serverFirst := string(cont.Data)
+	attrs := ParseSCRAMAttributes(serverFirst)
+	if !strings.HasPrefix(attrs["r"], clientNonce) {
+		return errors.New("SCRAM server nonce does not extend the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return err
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		return err
+	}
+
+	saltedPassword := PBKDF2SHA256([]byte(password), salt, iterations)
+	clientFinalWithoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	if err = send(frontend, &pgproto3.SASLResponse{Data: []byte(clientFinal)}); err != nil {
+		return err
+	}
+
+	msg, err = frontend.Receive()
+	if err != nil {
+		return err
+	}
+	final, ok := msg.(*pgproto3.AuthenticationSASLFinal)
+	if !ok {
+		return unexpectedMessage(msg)
+	}
+	serverKey := hmacSHA256(saltedPassword, "Server Key")
+	serverSignature := base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, authMessage))
+	if ParseSCRAMAttributes(string(final.Data))["v"] != serverSignature {
+		return errors.New("SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+// SCRAMServer verifies the SCRAM-SHA-256 proof of a password a client
+// sends, the server side of the exchange Authenticate runs.
+type SCRAMServer struct {
+	password        string
+	salt            []byte
+	nonce           string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+}
+
+// scramIterations is the iteration count of the salted passwords
+// SCRAMServer derives, the default of PostgreSQL.
+const scramIterations = 4096
+
+// NewSCRAMServer returns a SCRAMServer verifying password.
+func NewSCRAMServer(password string) *SCRAMServer {
+	return &SCRAMServer{password: password}
+}
+
+// First reads the client-first-message and returns the
+// server-first-message.
+func (s *SCRAMServer) First(clientFirst []byte) ([]byte, error) {
+	msg := string(clientFirst)
+	// gs2 header: channel binding flag and authorization identity
+	if !strings.HasPrefix(msg, "n,") && !strings.HasPrefix(msg, "y,") {
+		return nil, errors.New("SCRAM channel binding is not supported")
+	}
+	end := strings.Index(msg[2:], ",")
+	if end < 0 {
+		return nil, errors.New("malformed SCRAM client-first-message")
+	}
+	s.gs2Header, s.clientFirstBare = msg[:end+3], msg[end+3:]
+	clientNonce := ParseSCRAMAttributes(s.clientFirstBare)["r"]
+	if clientNonce == "" {
+		return nil, errors.New("SCRAM client nonce missing")
+	}
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.salt = make([]byte, 16)
+	if _, err = rand.Read(s.salt); err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.salt) +
+		",i=" + strconv.Itoa(scramIterations)
+	return []byte(s.serverFirst), nil
+}
+
+// Final verifies the client-final-message and returns the
+// server-final-message. ErrPasswordMismatch is returned if the proof does
+// not match the password.
+func (s *SCRAMServer) Final(clientFinal []byte) ([]byte, error) {
+	msg := string(clientFinal)
+	end := strings.LastIndex(msg, ",p=")
+	if end < 0 {
+		return nil, errors.New("SCRAM client proof missing")
+	}
+	clientFinalWithoutProof := msg[:end]
+	attrs := ParseSCRAMAttributes(clientFinalWithoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, errors.New("SCRAM channel binding mismatch")
+	}
+	if attrs["r"] != s.nonce {
+		return nil, errors.New("SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[end+3:])
+	if err != nil {
+		return nil, err
+	}
+
+	saltedPassword := PBKDF2SHA256([]byte(s.password), s.salt, scramIterations)
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + clientFinalWithoutProof
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	signature := hmacSHA256(storedKey[:], authMessage)
+	if len(proof) != len(signature) {
+		return nil, ErrPasswordMismatch
+	}
+	// the proof is the client key masked by the signature
+	for i := range signature {
+		signature[i] ^= proof[i]
+	}
+	proven := sha256.Sum256(signature)
+	if !hmac.Equal(proven[:], storedKey[:]) {
+		return nil, ErrPasswordMismatch
+	}
+	serverKey := hmacSHA256(saltedPassword, "Server Key")
+	return []byte("v=" + base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, authMessage))), nil
+}
+
+// ParseSCRAMAttributes splits a SCRAM message into its key=value attributes.
+func ParseSCRAMAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(attr, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// PBKDF2SHA256 derives a SCRAM salted password, see RFC 8018 section 5.2.
+func PBKDF2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
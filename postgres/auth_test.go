@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"errors"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serveSCRAM runs the server side of a SCRAM-SHA-256 exchange verifying
+// password on conn, as the proxy does, and returns the error of Final.
+func serveSCRAM(conn net.Conn, password string) error {
+	backend := pgproto3.NewBackend(conn, conn)
+	backend.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{scramSHA256}})
+	if err := backend.Flush(); err != nil {
+		return err
+	}
+	if err := backend.SetAuthType(pgproto3.AuthTypeSASL); err != nil {
+		return err
+	}
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+	server := NewSCRAMServer(password)
+	first, err := server.First(msg.(*pgproto3.SASLInitialResponse).Data)
+	if err != nil {
+		return err
+	}
+	backend.Send(&pgproto3.AuthenticationSASLContinue{Data: first})
+	if err = backend.Flush(); err != nil {
+		return err
+	}
+	if err = backend.SetAuthType(pgproto3.AuthTypeSASLContinue); err != nil {
+		return err
+	}
+	if msg, err = backend.Receive(); err != nil {
+		return err
+	}
+	final, err := server.Final(msg.(*pgproto3.SASLResponse).Data)
+	if err != nil {
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+		backend.Flush()
+		return err
+	}
+	backend.Send(&pgproto3.AuthenticationSASLFinal{Data: final})
+	backend.Send(&pgproto3.AuthenticationOk{})
+	return backend.Flush()
+}
+
+func TestSCRAM(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		err      error
+	}{
+		{name: "password", password: "secret"},
+		{name: "wrong password", password: "guess", err: ErrPasswordMismatch},
+		{name: "empty password", password: "", err: ErrPasswordMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			served := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				served <- serveSCRAM(server, "secret")
+			}()
+			err := Authenticate(pgproto3.NewFrontend(client, client), "app", tt.password)
+			if serverErr := <-served; !errors.Is(serverErr, tt.err) {
+				t.Fatalf("server: %v, want %v", serverErr, tt.err)
+			}
+			var pgErr *Error
+			switch {
+			case tt.err == nil && err != nil:
+				t.Errorf("client: %v", err)
+			case tt.err != nil && !errors.As(err, &pgErr):
+				t.Errorf("client: %v, want the error of the server", err)
+			}
+		})
+	}
+}
+
+func TestSCRAMServerRejectsMalformedMessages(t *testing.T) {
+	// the client-first-message, the client-final-message if it is
+	// accepted, and which of them is rejected
+	tests := []struct {
+		name               string
+		first, final       string
+		firstErr, finalErr bool
+	}{
+		{name: "channel binding", first: "p=tls-server-end-point,,n=,r=abc", firstErr: true},
+		{name: "no gs2 header", first: "n=,r=abc", firstErr: true},
+		{name: "no nonce", first: "n,,n=", firstErr: true},
+		{name: "no proof", first: "n,,n=,r=abc", final: "c=biws,r=abc", finalErr: true},
+		{name: "nonce", first: "n,,n=,r=abc", final: "c=biws,r=abc,p=AAAA", finalErr: true},
+		{name: "binding", first: "n,,n=,r=abc", final: "c=eSws,r=NONCE,p=AAAA", finalErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewSCRAMServer("secret")
+			_, err := server.First([]byte(tt.first))
+			if (err != nil) != tt.firstErr {
+				t.Fatalf("First: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			// NONCE stands for the nonce of the server
+			final := strings.ReplaceAll(tt.final, "NONCE", server.nonce)
+			_, err = server.Final([]byte(final))
+			if (err != nil) != tt.finalErr || err == ErrPasswordMismatch {
+				t.Errorf("Final: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package postgres
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Config holds what is needed to open a connection to a PostgreSQL server.
+type Config struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	// Params are sent as additional startup parameters.
+	Params map[string]string
+	// TLS encrypts connections if set. They stay plain with servers not
+	// supporting TLS, unless TLSRequired is set.
+	TLS         *tls.Config
+	TLSRequired bool
+	// ConnectTimeout bounds dialing, ReadTimeout and WriteTimeout each
+	// read and write of a connection. Zero means no timeout.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+}
+
+type Connector struct {
+	cfg *Config
+}
+
+// NewConnector returns a Connector opening connections described by cfg.
+func NewConnector(cfg *Config) *Connector {
+	return &Connector{cfg: cfg}
+}
+
+// ForDatabase returns a Connector opening connections like c does, to
+// database instead.
+func (c *Connector) ForDatabase(database string) *Connector {
+	cfg := *c.cfg
+	cfg.Database = database
+	return &Connector{cfg: &cfg}
+}
+
+// ForUser returns a Connector opening connections like c does, logged in
+// as user instead.
+func (c *Connector) ForUser(user, password string) *Connector {
+	cfg := *c.cfg
+	cfg.User, cfg.Password = user, password
+	return &Connector{cfg: &cfg}
+}
+
+// User returns the user connections are logged in as.
+func (c *Connector) User() string {
+	return c.cfg.User
+}
+
+// Connect opens and authenticates a new connection.
+func (c *Connector) Connect(ctx context.Context) (*PostgresConn, error) {
+	d := net.Dialer{Timeout: c.cfg.ConnectTimeout}
+	netConn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.ReadTimeout > 0 || c.cfg.WriteTimeout > 0 {
+		netConn = &timeoutConn{Conn: netConn, read: c.cfg.ReadTimeout, write: c.cfg.WriteTimeout}
+	}
+	if c.cfg.TLS != nil {
+		conn, err := StartTLS(netConn, c.cfg.TLS, c.cfg.TLSRequired)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = conn
+	}
+	pc := &PostgresConn{
+		netConn:      netConn,
+		frontend:     pgproto3.NewFrontend(netConn, netConn),
+		Params:       make(map[string]string),
+		statements:   make(map[string]*list.Element),
+		statementLRU: list.New(),
+	}
+
+	params := map[string]string{"user": c.cfg.User, "database": c.cfg.Database}
+	for k, v := range c.cfg.Params {
+		params[k] = v
+	}
+	err = pc.Send(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: params})
+	if err == nil {
+		err = Authenticate(pc.frontend, c.cfg.User, c.cfg.Password)
+	}
+	if err == nil {
+		err = pc.readUntilReady()
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// timeoutConn sets a deadline before each read and write of the connection
+// it wraps, for those with a timeout.
+type timeoutConn struct {
+	net.Conn
+	read, write time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// maxCachedStmts is the number of statements the proxy keeps prepared per
+// connection.
+const maxCachedStmts = 256
+
+// PostgresConn is a connection to a PostgreSQL server speaking the wire
+// protocol directly, so that messages can be relayed without re-encoding
+// their contents.
+type PostgresConn struct {
+	netConn  net.Conn
+	frontend *pgproto3.Frontend
+	mu       sync.Mutex
+	closed   bool
+	txStatus byte
+
+	statements   map[string]*list.Element // statements prepared by the proxy, by name
+	statementLRU *list.List               // names of prepared statements, most recently used first
+	evicted      []string                 // names of statements still to be closed
+
+	// Params holds the run-time parameters reported by the server.
+	Params map[string]string
+	// Settings holds the run-time parameters the proxy set on the
+	// connection, with the values they were set to.
+	Settings map[string]string
+}
+
+// Send writes msgs to the server.
+func (pc *PostgresConn) Send(msgs ...pgproto3.FrontendMessage) error {
+	for _, msg := range msgs {
+		pc.frontend.Send(msg)
+	}
+	if err := pc.frontend.Flush(); err != nil {
+		pc.Close()
+		return err
+	}
+	return nil
+}
+
+// Receive reads the next message from the server. The returned message is
+// only valid until the next call to Receive.
+func (pc *PostgresConn) Receive() (pgproto3.BackendMessage, error) {
+	msg, err := pc.frontend.Receive()
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *pgproto3.ReadyForQuery:
+		pc.txStatus = msg.TxStatus
+	case *pgproto3.ParameterStatus:
+		pc.Params[msg.Name] = msg.Value
+	}
+	return msg, nil
+}
+
+// readUntilReady reads messages until ReadyForQuery, returning the first
+// error reported by the server.
+func (pc *PostgresConn) readUntilReady() error {
+	var firstErr error
+	for {
+		msg, err := pc.Receive()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			if firstErr == nil {
+				firstErr = ErrorFromResponse(msg)
+			}
+		case *pgproto3.ReadyForQuery:
+			return firstErr
+		}
+	}
+}
+
+// Exec runs a simple query and discards its results.
+func (pc *PostgresConn) Exec(query string) error {
+	if err := pc.Send(&pgproto3.Query{String: query}); err != nil {
+		return err
+	}
+	return pc.readUntilReady()
+}
+
+// QueryRow runs a simple query and returns the text values of its first
+// row, nil for NULL, or no values if it returned no rows.
+func (pc *PostgresConn) QueryRow(query string) ([][]byte, error) {
+	if err := pc.Send(&pgproto3.Query{String: query}); err != nil {
+		return nil, err
+	}
+	var row [][]byte
+	var firstErr error
+	for {
+		msg, err := pc.Receive()
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			if row != nil {
+				continue
+			}
+			row = make([][]byte, len(msg.Values))
+			for i, value := range msg.Values {
+				if value != nil {
+					row[i] = append([]byte{}, value...)
+				}
+			}
+		case *pgproto3.ErrorResponse:
+			if firstErr == nil {
+				firstErr = ErrorFromResponse(msg)
+			}
+		case *pgproto3.ReadyForQuery:
+			return row, firstErr
+		}
+	}
+}
+
+// ResetSettings sets the run-time parameters back to their session
+// defaults if the proxy changed any.
+func (pc *PostgresConn) ResetSettings() error {
+	if len(pc.Settings) == 0 {
+		return nil
+	}
+	if err := pc.Exec("RESET ALL"); err != nil {
+		return err
+	}
+	pc.Settings = nil
+	return nil
+}
+
+// Prepared reports whether the proxy prepared the statement name on the
+// connection, marking it as recently used.
+func (pc *PostgresConn) Prepared(name string) bool {
+	e, ok := pc.statements[name]
+	if ok {
+		pc.statementLRU.MoveToFront(e)
+	}
+	return ok
+}
+
+// NotePrepared records that the server confirmed preparing the statement
+// name. Up to maxCachedStmts statements stay prepared, the least recently
+// used one is handed out by Evicted to make room for a new one.
+func (pc *PostgresConn) NotePrepared(name string) {
+	if _, ok := pc.statements[name]; ok {
+		return
+	}
+	if pc.statementLRU.Len() >= maxCachedStmts {
+		oldest := pc.statementLRU.Remove(pc.statementLRU.Back()).(string)
+		delete(pc.statements, oldest)
+		pc.evicted = append(pc.evicted, oldest)
+	}
+	pc.statements[name] = pc.statementLRU.PushFront(name)
+}
+
+// Evicted returns the names of the statements dropped from the cache, which
+// the caller must close with the next messages it sends.
+func (pc *PostgresConn) Evicted() []string {
+	names := pc.evicted
+	pc.evicted = nil
+	return names
+}
+
+// TxStatus returns the transaction status of the last ReadyForQuery.
+func (pc *PostgresConn) TxStatus() byte {
+	return pc.txStatus
+}
+
+// Close terminates the session and closes the connection.
+func (pc *PostgresConn) Close() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return nil
+	}
+	pc.closed = true
+	pc.frontend.Send(&pgproto3.Terminate{})
+	_ = pc.frontend.Flush()
+	return pc.netConn.Close()
+}
+
+// IsValid reports whether the connection can still be used.
+func (pc *PostgresConn) IsValid() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return !pc.closed
+}
@@ -0,0 +1,36 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+var (
+	ErrInvalidConn      = errors.New("invalid connection")
+	ErrPasswordMismatch = errors.New("password does not match")
+)
+
+// Error is an ErrorResponse received from the server.
+type Error struct {
+	Response pgproto3.ErrorResponse
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Response.Severity, e.Response.Message, e.Response.Code)
+}
+
+// ErrorFromResponse copies msg, which is only valid until the next Receive,
+// into an Error.
+func ErrorFromResponse(msg *pgproto3.ErrorResponse) *Error {
+	return &Error{Response: *msg}
+}
+
+// unexpectedMessage returns the error of a message out of place in an
+// exchange, the one the server reports if it is an ErrorResponse.
+func unexpectedMessage(msg pgproto3.BackendMessage) error {
+	if msg, ok := msg.(*pgproto3.ErrorResponse); ok {
+		return ErrorFromResponse(msg)
+	}
+	return fmt.Errorf("unexpected message %T", msg)
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"io"
+	"net"
+	"os"
+)
+
+var ErrTLSNotSupported = errors.New("server does not support TLS")
+
+// StartTLS asks the server on conn for TLS and returns the encrypted
+// connection. If the server declines, conn is returned as is, unless
+// required is set.
+func StartTLS(conn net.Conn, config *tls.Config, required bool) (net.Conn, error) {
+	if _, err := conn.Write((&pgproto3.SSLRequest{}).Encode(nil)); err != nil {
+		return nil, err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		return nil, err
+	}
+	switch answer[0] {
+	case 'S':
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	case 'N':
+		if required {
+			return nil, ErrTLSNotSupported
+		}
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unexpected answer %q to SSL request", answer[0])
+	}
+}
+
+// SSLModeConfig returns the TLS configuration of a libpq sslmode for
+// connections to host, and whether TLS is required. Certificates are
+// verified against the root certificates of the PEM file rootCert, or
+// those of the system if empty. It returns nil for disable.
+func SSLModeConfig(mode, host, rootCert string) (*tls.Config, bool, error) {
+	var roots *x509.CertPool
+	if rootCert != "" {
+		pem, err := os.ReadFile(rootCert)
+		if err != nil {
+			return nil, false, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, false, fmt.Errorf("no certificates in %s", rootCert)
+		}
+	}
+	switch mode {
+	case "disable":
+		return nil, false, nil
+	case "allow", "prefer":
+		return &tls.Config{InsecureSkipVerify: true}, false, nil
+	case "require":
+		if roots == nil {
+			return &tls.Config{InsecureSkipVerify: true}, true, nil
+		}
+		// with a root certificate, libpq verifies as verify-ca does
+		return verifyCAConfig(roots), true, nil
+	case "verify-ca":
+		return verifyCAConfig(roots), true, nil
+	case "verify-full":
+		return &tls.Config{RootCAs: roots, ServerName: host}, true, nil
+	default:
+		return nil, false, fmt.Errorf("unknown sslmode %s", mode)
+	}
+}
+
+// verifyCAConfig verifies the certificate chain of the server against
+// roots, but not its host name.
+func verifyCAConfig(roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
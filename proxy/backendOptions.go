@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"dbrwproxy/config"
+	"dbrwproxy/mysql"
+	"dbrwproxy/postgres"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// newMysqlConnector returns the connector of a MySQL secondary, with the
+// options of its configuration passed on as DSN parameters.
+func newMysqlConnector(secondary config.SecondaryDB) (*mysql.Connector, error) {
+	if err := checkTimeouts(secondary.Connection); err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	for k, v := range secondary.Params {
+		switch k {
+		case "tls", "timeout", "readTimeout", "writeTimeout", "charset", "collation":
+			return nil, fmt.Errorf("parameter %s is set by its own option", k)
+		}
+		params.Set(k, v)
+	}
+	if secondary.Charset != "" {
+		params.Set("charset", secondary.Charset)
+	}
+	if secondary.Collation != "" {
+		params.Set("collation", secondary.Collation)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"timeout":      secondary.ConnectTimeout,
+		"readTimeout":  secondary.ReadTimeout,
+		"writeTimeout": secondary.WriteTimeout,
+	} {
+		if timeout > 0 {
+			params.Set(name, timeout.String())
+		}
+	}
+	addr := net.JoinHostPort(secondary.Host, strconv.Itoa(secondary.Port))
+	dsn := fmt.Sprintf("tcp(%s)/%s", addr, secondary.DbName)
+	if len(params) > 0 {
+		dsn += "?" + params.Encode()
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.User, cfg.Passwd = secondary.User, secondary.Password
+
+	backend, err := newBackendTLS(secondary.TLS, addr, secondary.Connection)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLS, cfg.AllowFallbackToPlaintext = backend.config, !backend.required
+	return mysql.CreateConfigConnector(cfg)
+}
+
+// newPostgresConfig returns the connection configuration of a PostgreSQL
+// secondary, with the options libpq has for its configuration.
+func newPostgresConfig(secondary config.SecondaryDB) (*postgres.Config, error) {
+	if err := checkTimeouts(secondary.Connection); err != nil {
+		return nil, err
+	}
+	if secondary.Collation != "" {
+		return nil, errors.New("PostgreSQL has no collation per connection")
+	}
+	params := map[string]string{"application_name": "pgproxy"}
+	for k, v := range secondary.Params {
+		switch k {
+		case "user", "database", "client_encoding":
+			return nil, fmt.Errorf("parameter %s is set by its own option", k)
+		}
+		params[k] = v
+	}
+	if secondary.Charset != "" {
+		params["client_encoding"] = secondary.Charset
+	}
+
+	addr := net.JoinHostPort(secondary.Host, strconv.Itoa(secondary.Port))
+	backend, err := newPostgresBackendTLS(secondary.SSLMode, addr, secondary.Connection)
+	if err != nil {
+		return nil, err
+	}
+	return &postgres.Config{
+		Host:           secondary.Host,
+		Port:           secondary.Port,
+		User:           secondary.User,
+		Password:       secondary.Password,
+		Database:       secondary.DbName,
+		Params:         params,
+		TLS:            backend.config,
+		TLSRequired:    backend.required,
+		ConnectTimeout: secondary.ConnectTimeout,
+		ReadTimeout:    secondary.ReadTimeout,
+		WriteTimeout:   secondary.WriteTimeout,
+	}, nil
+}
+
+// checkMainOptions rejects the options that do not apply to the main
+// database.
+func checkMainOptions(conn config.Connection) error {
+	if conn.ReadTimeout != 0 {
+		// reads of a session wait on the main server while its client is idle
+		return errors.New("ReadTimeout does not apply to main database")
+	}
+	if conn.Charset != "" || conn.Collation != "" || len(conn.Params) > 0 {
+		return errors.New("clients choose Charset, Collation and Params of their sessions on main database")
+	}
+	return checkTimeouts(conn)
+}
+
+func checkTimeouts(conn config.Connection) error {
+	if conn.ConnectTimeout < 0 || conn.ReadTimeout < 0 || conn.WriteTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+// dialMain connects to the main server at addr with the timeouts of conn.
+func dialMain(addr *net.TCPAddr, conn config.Connection) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", addr.String(), conn.ConnectTimeout)
+	if err != nil || conn.WriteTimeout == 0 {
+		return c, err
+	}
+	return &writeTimeoutConn{Conn: c, timeout: conn.WriteTimeout}, nil
+}
+
+// writeTimeoutConn sets a deadline before each write of the connection it
+// wraps.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
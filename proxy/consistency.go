@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"fmt"
+	"time"
+)
+
+// Consistency modes, keeping the reads of a session on the main server
+// after it wrote, or on secondaries that replayed its writes.
+const (
+	consistencyNone    = ""
+	consistencyWindow  = "window"
+	consistencySession = "session"
+	consistencyCausal  = "causal"
+
+	// defaultCausalWindow is how long causal reads stay on the main server
+	// after a write whose position is unknown, without ConsistencyWindow.
+	defaultCausalWindow = time.Second
+)
+
+// stickiness tracks the writes of a session to read its own writes back.
+type stickiness struct {
+	mode   string
+	window time.Duration
+	// wait is how long a causal read waits for a secondary to replay the
+	// writes of the session.
+	wait time.Duration
+	// lastWrite is when the main server was last known to have completed
+	// a write of the session, and committed it.
+	lastWrite time.Time
+	// pending is set from routing a write until it is completed.
+	pending bool
+	// position is where the history of the main server was after the last
+	// write of the session, for causal reads.
+	position string
+}
+
+func newStickiness(mode string, window, wait time.Duration) (stickiness, error) {
+	switch mode {
+	case consistencyNone, consistencySession:
+	case consistencyCausal:
+		if window <= 0 {
+			window = defaultCausalWindow
+		}
+	case consistencyWindow:
+		if window <= 0 {
+			return stickiness{}, fmt.Errorf("consistency window %v is not positive", window)
+		}
+	default:
+		return stickiness{}, fmt.Errorf("invalid consistency %q", mode)
+	}
+	return stickiness{mode: mode, window: window, wait: wait}, nil
+}
+
+// wrote records the verdict of a statement routed to the main server.
+func (s *stickiness) wrote(verdict classifier.Verdict) {
+	if verdict.Kind == classifier.Write || verdict.Kind != classifier.Read && verdict.Statements > 1 {
+		s.pending = true
+	}
+}
+
+// sticky reports whether the reads of the session must stay on the main
+// server to see its writes. It is asked before routing each statement:
+// by then the main server completed the previous ones, so a pending write
+// outside a transaction is committed and its window starts. For causal
+// reads, position then tells where the main server is, or "" if unknown,
+// in which case reads stay on the main server for the window.
+func (s *stickiness) sticky(inTrans bool, position func() string) bool {
+	if s.pending && !inTrans {
+		s.pending = false
+		s.lastWrite = time.Now()
+		if s.mode == consistencyCausal && position != nil {
+			s.position = position()
+		}
+	}
+	if s.lastWrite.IsZero() {
+		return false
+	}
+	switch s.mode {
+	case consistencyWindow:
+		return time.Since(s.lastWrite) < s.window
+	case consistencySession:
+		return true
+	case consistencyCausal:
+		return s.position == "" && time.Since(s.lastWrite) < s.window
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"testing"
+	"time"
+)
+
+func TestStickiness(t *testing.T) {
+	write := classifier.Verdict{Kind: classifier.Write, Statements: 1}
+	tests := []struct {
+		name     string
+		mode     string
+		window   time.Duration
+		position string
+		// since is how long ago the write completed
+		since time.Duration
+		want  bool
+	}{
+		{name: "none", mode: consistencyNone},
+		{name: "window", mode: consistencyWindow, window: time.Minute, want: true},
+		{name: "window over", mode: consistencyWindow, window: time.Minute, since: 2 * time.Minute},
+		{name: "session", mode: consistencySession, since: time.Hour, want: true},
+		{name: "causal with position", mode: consistencyCausal, position: "uuid:1-5"},
+		{name: "causal without position", mode: consistencyCausal, want: true},
+		{name: "causal without position, window over", mode: consistencyCausal, since: 2 * defaultCausalWindow},
+		{name: "causal without position, window set", mode: consistencyCausal, window: time.Minute, since: 2 * defaultCausalWindow, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newStickiness(tt.mode, tt.window, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.wrote(write)
+			if s.sticky(true, nil) && tt.mode != consistencyNone {
+				t.Error("sticky before the write completed")
+			}
+			s.sticky(false, func() string { return tt.position })
+			s.lastWrite = s.lastWrite.Add(-tt.since)
+			if got := s.sticky(false, nil); got != tt.want {
+				t.Errorf("sticky() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
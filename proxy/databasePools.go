@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"dbrwproxy/config"
+	"dbrwproxy/mysql"
+	"dbrwproxy/pool"
+	"dbrwproxy/postgres"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mysqlPools holds the pools of connections to a MySQL secondary other than
+// the configured one, to other databases or with the credentials of other
+// users, opened as clients need them.
+type mysqlPools struct {
+	mu        sync.Mutex
+	name      string
+	connector *mysql.Connector
+	min, max  int
+	lifeTime  time.Duration
+	pools     map[string]*pool.ConnectionPool
+	// used holds when each pool was last handed out
+	used map[string]time.Time
+}
+
+func newMysqlPools(name string, connector *mysql.Connector, min, max int, lifeTime time.Duration) *mysqlPools {
+	return &mysqlPools{
+		name:      name,
+		connector: connector,
+		min:       min,
+		max:       max,
+		lifeTime:  lifeTime,
+		pools:     make(map[string]*pool.ConnectionPool),
+		used:      make(map[string]time.Time),
+	}
+}
+
+// get returns the pool of connections to database logged in with login,
+// or with the configured credentials if nil, opening it the first time.
+// Pools not handed out for the idle time of their connections are closed.
+func (mp *mysqlPools) get(login *config.Credentials, database string) *pool.ConnectionPool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	key := poolKey(login, database)
+	now := time.Now()
+	for other, used := range mp.used {
+		if other != key && now.Sub(used) > mp.lifeTime {
+			database, _, _ := strings.Cut(other, "\x00")
+			log.Println("Close idle pool of", mp.name, "to database", database)
+			mp.pools[other].Close()
+			delete(mp.pools, other)
+			delete(mp.used, other)
+		}
+	}
+	mp.used[key] = now
+	connPool := mp.pools[key]
+	if connPool == nil {
+		connector := mp.connector.ForDatabase(database)
+		if login != nil {
+			connector = connector.ForUser(login.User, login.Password)
+		}
+		log.Println("Open pool of", mp.name, "to database", database, "as", connector.User())
+		connPool = pool.NewConnectionPool(connector, mp.min, mp.max, mp.lifeTime)
+		mp.pools[key] = connPool
+	}
+	return connPool
+}
+
+// close closes all pools.
+func (mp *mysqlPools) close() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, connPool := range mp.pools {
+		connPool.Close()
+	}
+}
+
+// postgresPools holds the pools of connections to a PostgreSQL secondary
+// other than the configured one, to other databases or with the
+// credentials of other users, opened as clients need them.
+type postgresPools struct {
+	mu        sync.Mutex
+	name      string
+	connector *postgres.Connector
+	min, max  int
+	lifeTime  time.Duration
+	pools     map[string]*pool.PostgresConnectionPool
+	// used holds when each pool was last handed out
+	used map[string]time.Time
+}
+
+func newPostgresPools(name string, connector *postgres.Connector, min, max int, lifeTime time.Duration) *postgresPools {
+	return &postgresPools{
+		name:      name,
+		connector: connector,
+		min:       min,
+		max:       max,
+		lifeTime:  lifeTime,
+		pools:     make(map[string]*pool.PostgresConnectionPool),
+		used:      make(map[string]time.Time),
+	}
+}
+
+// get returns the pool of connections to database logged in with login,
+// or with the configured credentials if nil, opening it the first time.
+// Pools not handed out for the idle time of their connections are closed.
+func (pp *postgresPools) get(login *config.Credentials, database string) *pool.PostgresConnectionPool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	key := poolKey(login, database)
+	now := time.Now()
+	for other, used := range pp.used {
+		if other != key && now.Sub(used) > pp.lifeTime {
+			database, _, _ := strings.Cut(other, "\x00")
+			log.Println("Close idle pool of", pp.name, "to database", database)
+			pp.pools[other].Close()
+			delete(pp.pools, other)
+			delete(pp.used, other)
+		}
+	}
+	pp.used[key] = now
+	connPool := pp.pools[key]
+	if connPool == nil {
+		connector := pp.connector.ForDatabase(database)
+		if login != nil {
+			connector = connector.ForUser(login.User, login.Password)
+		}
+		log.Println("Open pool of", pp.name, "to database", database, "as", connector.User())
+		connPool = pool.NewPostgresConnectionPool(connector, pp.min, pp.max, pp.lifeTime)
+		pp.pools[key] = connPool
+	}
+	return connPool
+}
+
+// close closes all pools.
+func (pp *postgresPools) close() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, connPool := range pp.pools {
+		connPool.Close()
+	}
+}
+
+// poolKey identifies the pool of connections to database logged in with
+// login.
+func poolKey(login *config.Credentials, database string) string {
+	if login == nil {
+		return database
+	}
+	return database + "\x00" + login.User
+}
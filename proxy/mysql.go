@@ -2,35 +2,112 @@ package proxy
 
 import (
 	"database/sql/driver"
+	"dbrwproxy/classifier"
 	"dbrwproxy/config"
 	"dbrwproxy/mysql"
 	"dbrwproxy/pool"
-	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 var MysqlDBs []WeightedMysqlDB
 
+const (
+	// ER_UNKNOWN_ERROR, used for failures generated by the proxy itself
+	erUnknownError = 1105
+	// ER_SPECIFIC_ACCESS_DENIED_ERROR, used for statements rejected by rules
+	erSpecificAccessDenied = 1227
+	erNotSupportedYet      = 1235
+	// SQLSTATE class 08, communication link failure
+	sqlStateCommunicationLink = "08S01"
+	// SQLSTATE class 42, syntax error or access rule violation
+	sqlStateAccessRule = "42000"
+)
+
 type MysqlProxy struct {
 	localAddr, remoteAddr *net.TCPAddr
-	localConn, remoteConn *net.TCPConn
+	localConn, remoteConn net.Conn
 	dbs                   []WeightedMysqlDB
 	totalWeight           int
-	regex                 []*regexp.Regexp
+	classifier            *classifier.Classifier
+	stripHints            bool
+	rules                 []*rule
+	client                clientInfo
 	exit                  bool
-	inTrans               bool
+	// users authenticates clients at the proxy, nil if they authenticate
+	// with the main server.
+	users *userList
+	// tls is how the proxy secures clients asking for TLS, without a
+	// configuration if it relays their sessions encrypted, mainTLS how it
+	// connects to the main server.
+	tls     listenerTLS
+	mainTLS backendTLS
+	// mainOptions holds the timeouts of connections to the main server.
+	mainOptions config.Connection
+	// status follows the main server's responses for the transaction
+	// state of the session.
+	status *mysql.StatusTracker
+	// consistency follows the writes of the session to read them back.
+	consistency stickiness
+	// state pins the session to the main server while it holds
+	// session-scoped state there.
+	state sessionState
+	// settings are set on the secondary connections reads run on.
+	settings sessionSettings
+	// pinned is the secondary connection running the read-only transaction
+	// of the session, pinnedNext set while it waits for the transaction
+	// SET TRANSACTION READ ONLY applies to.
+	pinned     *mysql.MysqlConn
+	pinnedDB   *WeightedMysqlDB
+	pinnedPool *pool.ConnectionPool
+	pinnedNext bool
+	// executedGTIDs holds the GTID set each secondary was last seen to
+	// have executed, for causal reads.
+	executedGTIDs map[string]string
+	// clientHello tells handleOutbound whether the client asked for TLS
+	// in reply to the server greeting.
+	clientHello chan bool
+
+	// prepared statements, see delegateStmt
+	stmtMu          sync.Mutex
+	statements      map[uint32]*mysqlStatement
+	pendingPrepares []pendingPrepare
 }
 
 type WeightedMysqlDB struct {
 	Name   string
+	Group  string
 	Db     *pool.ConnectionPool
 	Weight int
+	lag    *lagProbe
+	// dbName is the database Db connects to, databases the pools to the
+	// others.
+	dbName    string
+	databases *mysqlPools
+}
+
+// poolFor returns the pool of connections for the reads of client, to the
+// database it selected with the credentials it reads with.
+func (db *WeightedMysqlDB) poolFor(client *clientInfo) *pool.ConnectionPool {
+	database := client.database
+	if database == "" {
+		database = db.dbName
+	}
+	if database == db.dbName && client.secondary == nil {
+		return db.Db
+	}
+	return db.databases.get(client.secondary, database)
+}
+
+// Close closes the pools of connections to the secondary.
+func (db *WeightedMysqlDB) Close() {
+	db.Db.Close()
+	db.databases.close()
 }
 
 func StartMysql(conf config.Proxy) {
@@ -56,6 +133,40 @@ func StartMysql(conf config.Proxy) {
 		return
 	}
 	MysqlDBs = dbs
+	cls := classifier.New(classifier.MySQL, conf.MainFunctions)
+	secondaries := make(map[string]string)
+	for _, db := range dbs {
+		secondaries[db.Name] = db.Group
+	}
+	rules, err := compileRules(conf.Rules, secondaries)
+	if err != nil {
+		log.Fatalln("Invalid rules of Proxy", conf.Name, err)
+		return
+	}
+	consistency, err := newStickiness(conf.Consistency, conf.ConsistencyWindow, conf.CausalWait)
+	if err != nil {
+		log.Fatalln("Invalid consistency of Proxy", conf.Name, err)
+		return
+	}
+	users, err := newUserList(conf, mysqlAuthMethods)
+	if err != nil {
+		log.Fatalln("Invalid users of Proxy", conf.Name, err)
+		return
+	}
+	clientTLS, err := serverTLS(conf.Server)
+	if err != nil {
+		log.Fatalln("Invalid TLS certificate of Proxy", conf.Name, err)
+		return
+	}
+	if err = checkMainOptions(conf.Db.Main.Connection); err != nil {
+		log.Fatalln("Invalid options of main DB of Proxy", conf.Name, err)
+		return
+	}
+	mainTLS, err := newBackendTLS(conf.Db.Main.TLS, conf.Db.Main.Addr, conf.Db.Main.Connection)
+	if err != nil {
+		log.Fatalln("Invalid TLS of main DB of Proxy", conf.Name, err)
+		return
+	}
 	log.Println("Mysql Proxy listening on", conf.Server.ProxyAddr)
 
 	for {
@@ -66,42 +177,91 @@ func StartMysql(conf config.Proxy) {
 		}
 
 		p := &MysqlProxy{
-			localConn:   conn,
-			localAddr:   localAddr,
-			remoteAddr:  remoteAddr,
-			dbs:         dbs,
-			totalWeight: totalWeight,
+			localConn:     conn,
+			localAddr:     localAddr,
+			remoteAddr:    remoteAddr,
+			dbs:           dbs,
+			totalWeight:   totalWeight,
+			classifier:    cls,
+			consistency:   consistency,
+			stripHints:    conf.StripHints,
+			rules:         rules,
+			users:         users,
+			tls:           clientTLS,
+			mainOptions:   conf.Db.Main.Connection,
+			mainTLS:       mainTLS,
+			client:        clientInfo{addr: conn.RemoteAddr().(*net.TCPAddr).IP},
+			state:         newSessionState(conn.RemoteAddr().String()),
+			status:        mysql.NewStatusTracker(),
+			clientHello:   make(chan bool, 1),
+			statements:    make(map[uint32]*mysqlStatement),
+			executedGTIDs: make(map[string]string),
 		}
-		p.regex = initRegexp()
 		go p.service()
 	}
 }
 
 func (p *MysqlProxy) service() {
 	defer p.localConn.Close()
-	conn, err := net.DialTCP("tcp", nil, p.remoteAddr)
+	conn, err := dialMain(p.remoteAddr, p.mainOptions)
 	if err != nil {
-		log.Printf("Remote connection failed:", err)
+		log.Println("Remote connection failed:", err)
 		return
 	}
 	p.remoteConn = conn
 	defer p.remoteConn.Close()
-	go p.handleOutbound()
-	p.handleInbound()
+	local := mysql.NewPacketReader(p.localConn)
+	remote := mysql.NewPacketReader(p.remoteConn)
+	switch {
+	case p.users != nil:
+		local, remote, err = p.login(local, remote)
+	case p.tls.config != nil:
+		local, remote, err = p.relayLogin(local, remote)
+	}
+	if err != nil {
+		log.Println("Login failed:", err)
+		return
+	}
+	go p.handleOutbound(remote)
+	p.handleInbound(local)
+	p.unpin()
 	p.exit = true
+	// release handleOutbound if the client left before its first packet
+	select {
+	case p.clientHello <- false:
+	default:
+	}
 }
 
-func (p *MysqlProxy) handleInbound() {
-	buff := make([]byte, 65536)
-	for {
-		n, err := p.localConn.Read(buff)
+func (p *MysqlProxy) handleInbound(reader *mysql.PacketReader) {
+	for first := !p.answersHandshake(); ; first = false {
+		pkt, err := reader.ReadPacket()
 		if err != nil {
 			if err != io.EOF {
 				log.Println("Read local failed:", err)
 			}
 			return
 		}
-		flag, err := p.delegateSelect(n, buff[:n])
+		if first {
+			p.clientHello <- pkt.IsSSLRequest()
+			p.client.user, p.client.database = mysql.ParseHandshakeResponse(pkt.Payload)
+		}
+		if pkt.IsSSLRequest() {
+			// the rest of the session is encrypted, relay it unchanged
+			_, err = p.remoteConn.Write(pkt.Raw)
+			if err == nil {
+				_, err = io.Copy(p.remoteConn, reader)
+			}
+			if err != nil && !p.exit {
+				log.Println("Write failed:", err)
+			}
+			return
+		}
+		flag, err := p.delegateSelect(pkt)
+		if flag && err != nil {
+			log.Println("Write failed:", err)
+			return
+		}
 		if !flag {
 			if err != nil {
 				log.Println(err)
@@ -111,7 +271,8 @@ func (p *MysqlProxy) handleInbound() {
 				}
 				return
 			}
-			n, err = p.remoteConn.Write(buff[0:n])
+			p.status.Command(pkt)
+			_, err = p.remoteConn.Write(pkt.Raw)
 			if err != nil {
 				log.Println("Write failed:", err)
 				return
@@ -120,48 +281,352 @@ func (p *MysqlProxy) handleInbound() {
 	}
 }
 
-func (p *MysqlProxy) delegateSelect(n int, buffer []byte) (bool, error) {
-	if n <= 5 || buffer[4] != 3 {
+// answersHandshake reports whether the proxy runs the handshake with the
+// client itself, before relaying commands, rather than relaying it.
+func (p *MysqlProxy) answersHandshake() bool {
+	return p.users != nil || p.tls.config != nil
+}
+
+func (p *MysqlProxy) delegateSelect(pkt *mysql.Packet) (bool, error) {
+	if database, ok := p.status.Database(); ok {
+		p.client.database = database
+	}
+	switch pkt.Command() {
+	case mysql.ComStmtPrepare, mysql.ComStmtExecute, mysql.ComStmtSendLongData,
+		mysql.ComStmtReset, mysql.ComStmtClose:
+		return p.delegateStmt(pkt)
+	case mysql.ComInitDB:
+		if p.pinned != nil {
+			// the main session would stay on the database it was on
+			return true, p.writeNotSupported(pkt.Sequence+1, "COM_INIT_DB", "in a read-only transaction on a secondary")
+		}
+		// the database changes once the main server accepts it
+		p.status.SelectsDatabase(string(pkt.Payload[1:]))
+		return false, nil
+	case mysql.ComChangeUser:
+		if p.users != nil {
+			// the client would authenticate with the main server
+			return true, p.writeNotSupported(pkt.Sequence+1, "COM_CHANGE_USER", "with a user list")
+		}
+		user, database := mysql.ParseChangeUser(pkt.Payload)
+		p.client.user = user
+		p.status.SelectsDatabase(database)
+		// the session starts over
+		p.unpin()
+		p.state.reset()
+		p.settings = sessionSettings{}
+		return false, nil
+	case mysql.ComResetConnection:
+		p.state.reset()
+		p.settings = sessionSettings{}
+		return false, nil
+	case mysql.ComQuery:
+	default:
 		return false, nil
 	}
-	sql := strings.Trim(string(buffer[5:n]), " \r\n")
-	matchSelect := p.regex[0].MatchString(sql)
-	if p.inTrans || !matchSelect {
-		matchTranBegin := p.regex[1].MatchString(sql)
-		if matchTranBegin {
-			p.inTrans = true
-		}
-		if p.inTrans {
-			matchTranEnd := p.regex[2].MatchString(sql)
-			if matchTranEnd {
-				p.inTrans = false
-			}
+	hints, sql := p.hints(string(pkt.Payload[1:]))
+	if len(sql) != len(pkt.Payload)-1 {
+		*pkt = *mysql.NewPacket(pkt.Sequence, append([]byte{mysql.ComQuery}, sql...))
+	}
+	sql = strings.Trim(sql, " \r\n")
+	if p.pinned != nil {
+		if verdict := p.classifier.Classify(sql); verdict.Kind == classifier.Session &&
+			!strings.HasPrefix(verdict.Reason, "SHOW") {
+			// USE, SET and user variables would change the pinned session
+			// only, not the main one the client goes on with
+			return true, p.writeNotSupported(pkt.Sequence+1, verdict.Reason, "in a read-only transaction on a secondary")
 		}
-		log.Println("Choose main")
+		err := p.writeDataRow(p.pinned, sql)
+		return true, p.endPinned(pkt.Sequence, err, false)
+	}
+	weighted, rt := p.route(sql, hints)
+	if rt.reject != nil {
+		return true, p.writeReject(pkt.Sequence+1, rt.reject)
+	}
+	if weighted == nil {
 		log.Println("Execute SQL -> [" + sql + "]")
 		return false, nil
 	}
-	db := p.chooseByWeight()
+	db := weighted.poolFor(&p.client)
 	conn, err := db.Get()
 	if err != nil {
-		return true, err
+		log.Println("Secondary connection failed:", err)
+		return true, p.writeError(pkt.Sequence+1, err)
+	}
+	if err = p.configure(conn); err != nil {
+		log.Println("Choose main instead: session settings failed on", weighted.Name, err)
+		db.Put(conn)
+		log.Println("Execute SQL -> [" + sql + "]")
+		return false, nil
+	}
+	if rt.pin {
+		log.Println("Pin", weighted.Name, "for read-only transaction")
+		p.pinned, p.pinnedDB, p.pinnedPool = conn, weighted, db
+		err = p.writeDataRow(conn, sql)
+		return true, p.endPinned(pkt.Sequence, err, true)
 	}
 	defer db.Put(conn)
-	p.writeDataRow(conn, sql)
+	err = p.writeDataRow(conn, sql)
+	if err != nil {
+		log.Println("Secondary query failed:", err)
+		if _, ok := err.(*mysql.MySQLError); !ok {
+			// server errors have already been relayed as they were read
+			sequence := conn.Sequence()
+			if sequence == 0 {
+				// the query was never sent
+				sequence = pkt.Sequence + 1
+			}
+			return true, p.writeError(sequence, err)
+		}
+	}
 	return true, nil
 }
 
-func (p *MysqlProxy) chooseByWeight() *pool.ConnectionPool {
+// endPinned ends a command run on the pinned connection, unpinning it once
+// the read-only transaction is over. The first command of the transaction
+// is the one it started with.
+func (p *MysqlProxy) endPinned(sequence byte, err error, first bool) error {
+	if err != nil {
+		log.Println("Secondary query failed:", err)
+		if _, ok := err.(*mysql.MySQLError); !ok {
+			// server errors have already been relayed as they were read
+			next := p.pinned.Sequence()
+			if next == 0 {
+				// the command was never sent
+				next = sequence + 1
+			}
+			p.pinned.Close()
+			p.unpin()
+			return p.writeError(next, err)
+		}
+	}
+	switch {
+	case p.pinned.Status().InReadOnlyTrans():
+		p.pinnedNext = false
+	case first && err == nil:
+		// SET TRANSACTION READ ONLY, for the next transaction
+		p.pinnedNext = true
+	default:
+		p.unpin()
+	}
+	return nil
+}
+
+// unpin returns the pinned connection to its pool, closing it if it is
+// still in a transaction.
+func (p *MysqlProxy) unpin() {
+	if p.pinned == nil {
+		return
+	}
+	if p.pinned.Status().InTrans() || p.pinnedNext {
+		p.pinned.Close()
+	}
+	p.pinnedPool.Put(p.pinned)
+	log.Println("Unpin", p.pinnedDB.Name)
+	p.pinned, p.pinnedDB, p.pinnedPool, p.pinnedNext = nil, nil, nil, false
+}
+
+// configure sets the session variables of the client on a secondary
+// connection, as far as they differ.
+func (p *MysqlProxy) configure(conn *mysql.MysqlConn) error {
+	names, reset := p.settings.delta(conn.Settings)
+	if reset {
+		if err := conn.ResetSettings(); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	items := make([]string, len(names))
+	for i, name := range names {
+		value := p.settings.values[name]
+		switch name {
+		case "names":
+			items[i] = "NAMES " + value
+		case "character set":
+			items[i] = "CHARACTER SET " + value
+		default:
+			items[i] = "SESSION " + name + " = " + value
+		}
+	}
+	if _, err := conn.Exec("SET "+strings.Join(items, ", "), nil); err != nil {
+		return err
+	}
+	conn.Settings = p.settings.applied(conn.Settings, names)
+	return nil
+}
+
+// writeNotSupported answers a command the proxy cannot run where the
+// session needs it with an ERR packet.
+func (p *MysqlProxy) writeNotSupported(sequence byte, what, where string) error {
+	me := &mysql.MySQLError{
+		Number:  erNotSupportedYet,
+		Message: "dbrwproxy: " + what + " not supported " + where,
+	}
+	copy(me.SQLState[:], sqlStateAccessRule)
+	return mysql.WriteErrorPacket(p.localConn, sequence, me)
+}
+
+// writeError reports a failure that happened on the way to or from a
+// secondary to the client as an ERR packet.
+func (p *MysqlProxy) writeError(sequence byte, err error) error {
+	me := &mysql.MySQLError{
+		Number:  erUnknownError,
+		Message: "dbrwproxy: secondary unavailable: " + err.Error(),
+	}
+	copy(me.SQLState[:], sqlStateCommunicationLink)
+	return mysql.WriteErrorPacket(p.localConn, sequence, me)
+}
+
+// hints reads the routing hints of query. The query returned is the one to
+// send, stripped of the hints if so configured.
+func (p *MysqlProxy) hints(query string) (classifier.Hints, string) {
+	hints, stripped, err := p.classifier.Hints(query)
+	if err != nil {
+		log.Println("Ignoring routing hint:", err)
+	}
+	if p.stripHints {
+		return hints, stripped
+	}
+	return hints, query
+}
+
+// route returns the secondary query runs on, or nil if it runs on the main
+// server or is rejected, logging why, and the routing decided.
+func (p *MysqlProxy) route(query string, hints classifier.Hints) (*WeightedMysqlDB, routing) {
+	inTrans := p.inTransaction()
+	rt := routeStatement(p.classifier, p.rules, &p.client, query, hints, inTrans, p.state.reason(),
+		p.consistency.sticky(inTrans, p.status.GTIDs))
+	if rt.reject != nil {
+		log.Println("Reject: rule", rt.reject.name)
+		return nil, rt
+	}
+	if !rt.main && rt.verdict.Statements > 1 {
+		// secondary connections do not enable multiple statements
+		rt.main, rt.reason = true, "multiple statements"
+	}
+	if rt.main {
+		log.Println("Choose main:", rt.reason)
+		p.consistency.wrote(rt.verdict)
+		p.state.update(rt.verdict.State)
+		p.settings.update(rt.verdict.Settings)
+		if rt.verdict.Database != "" {
+			p.status.SelectsDatabase(rt.verdict.Database)
+		}
+		return nil, rt
+	}
+	sel := rt.sel
+	sel.position = p.consistency.position
+	db := p.chooseSecondary(sel)
+	if db == nil && sel.position != "" && p.consistency.wait > 0 {
+		// wait for a secondary to catch up
+		sel.position = ""
+		db = p.chooseSecondary(sel)
+		if db != nil && !p.executed(db, p.consistency.position, p.consistency.wait) {
+			log.Println("Choose main:", db.Name, "did not execute GTIDs", p.consistency.position)
+			return nil, rt
+		}
+	}
+	if db == nil {
+		log.Println("Choose main: no secondary matches")
+	}
+	return db, rt
+}
+
+// executed reports whether db executed the GTID set gtids, waiting up to
+// wait for it to.
+func (p *MysqlProxy) executed(db *WeightedMysqlDB, gtids string, wait time.Duration) bool {
+	if p.executedGTIDs[db.Name] == gtids {
+		return true
+	}
+	ok, err := mysqlExecuted(db.Db, gtids, wait)
+	if err != nil {
+		log.Println("Failed to check GTIDs of", db.Name, err)
+		return false
+	}
+	if ok {
+		p.executedGTIDs[db.Name] = gtids
+	}
+	return ok
+}
+
+// writeReject answers a statement rejected by a rule with an ERR packet.
+func (p *MysqlProxy) writeReject(sequence byte, r *rule) error {
+	me := &mysql.MySQLError{
+		Number:  erSpecificAccessDenied,
+		Message: "dbrwproxy: statement rejected by rule " + r.name,
+	}
+	copy(me.SQLState[:], sqlStateAccessRule)
+	return mysql.WriteErrorPacket(p.localConn, sequence, me)
+}
+
+// inTransaction reports whether the session has a transaction open on the
+// main server, or opens one with its next statement as autocommit is off.
+// While the main server has not answered all commands, as when a client
+// pipelines a BEGIN and a SELECT, its last status may be outdated and the
+// session counts as in a transaction.
+func (p *MysqlProxy) inTransaction() bool {
+	status := p.status.Status()
+	return p.status.Pending() || status.InTrans() || !status.Autocommit()
+}
+
+func (p *MysqlProxy) chooseByWeight() *WeightedMysqlDB {
 	randomNum := rand.Intn(p.totalWeight)
 	currentWeight := 0
-	for _, element := range p.dbs {
-		currentWeight += element.Weight
+	for i := range p.dbs {
+		currentWeight += p.dbs[i].Weight
 		if randomNum < currentWeight {
-			log.Println("Choose", element.Name)
-			return element.Db
+			log.Println("Choose", p.dbs[i].Name)
+			return &p.dbs[i]
 		}
 	}
-	return p.dbs[0].Db
+	return &p.dbs[0]
+}
+
+// chooseSecondary chooses a secondary by weight among those sel allows,
+// returning nil if there is none. Secondaries are checked for the GTIDs of
+// sel in the order they are chosen, until one executed them.
+func (p *MysqlProxy) chooseSecondary(sel selector) *WeightedMysqlDB {
+	if sel == (selector{}) {
+		return p.chooseByWeight()
+	}
+	var candidates []*WeightedMysqlDB
+	total := 0
+	for i := range p.dbs {
+		db := &p.dbs[i]
+		if sel.name != "" && db.Name != sel.name || sel.group != "" && db.Group != sel.group {
+			continue
+		}
+		if sel.maxLag > 0 {
+			lag, err := db.lag.Lag()
+			if err != nil || lag > sel.maxLag {
+				log.Println("Skip", db.Name, "replication lag", lag, err)
+				continue
+			}
+		}
+		candidates = append(candidates, db)
+		total += db.Weight
+	}
+	for len(candidates) > 0 {
+		randomNum := rand.Intn(total)
+		i := 0
+		for ; i < len(candidates)-1; i++ {
+			randomNum -= candidates[i].Weight
+			if randomNum < 0 {
+				break
+			}
+		}
+		db := candidates[i]
+		if sel.position == "" || p.executed(db, sel.position, 0) {
+			log.Println("Choose", db.Name)
+			return db
+		}
+		log.Println("Skip", db.Name, "GTIDs not executed")
+		candidates = append(candidates[:i], candidates[i+1:]...)
+		total -= db.Weight
+	}
+	return nil
 }
 
 func (p *MysqlProxy) writeDataRow(db *mysql.MysqlConn, query string) error {
@@ -173,34 +638,75 @@ func (p *MysqlProxy) writeDataRow(db *mysql.MysqlConn, query string) error {
 
 	values := make([]driver.Value, len(rows.Columns()))
 	for {
-		if rows.Next1(values, p.localConn) == io.EOF {
-			break
+		err = rows.Next1(values, p.localConn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 	}
-
-	return nil
 }
 
-func (p *MysqlProxy) handleOutbound() {
-	buff := make([]byte, 65536)
-	for {
-		n, err := p.remoteConn.Read(buff)
+func (p *MysqlProxy) handleOutbound(reader *mysql.PacketReader) {
+	for greeting := !p.answersHandshake(); ; greeting = false {
+		pkt, err := reader.ReadPacket()
 		if err != nil {
 			if err != io.EOF && !p.exit {
 				log.Println("Read remote failed:", err)
 			}
 			return
 		}
-		if n < 1 {
-			continue
+		p.capturePrepare(pkt)
+		if p.status.Response(pkt) && p.consistency.mode == consistencyCausal {
+			// before the client can send a command
+			err = p.trackGTIDs(reader)
+			if err != nil {
+				log.Println("Read remote failed:", err)
+				return
+			}
 		}
-		n, err = p.localConn.Write(buff[0:n])
+		_, err = p.localConn.Write(pkt.Raw)
 		if err != nil {
 			log.Println("Write failed:", err)
 			return
 		}
+		if greeting && <-p.clientHello {
+			// the rest of the session is encrypted, relay it unchanged
+			_, err = io.Copy(p.localConn, reader)
+			if err != nil && !p.exit {
+				log.Println("Write failed:", err)
+			}
+			return
+		}
 	}
-	log.Println("handle outbound returned!!!")
+}
+
+// trackGTIDs has the main server report the GTIDs of the transactions the
+// session commits in its OK packets, for causal reads, setting
+// session_track_gtids in the session of the client. It is only called with
+// Consistency causal, and the setting stays for the rest of the session,
+// where the client sees it too. Where it cannot, the reads of the session
+// stay on the main server for the consistency window after its writes.
+func (p *MysqlProxy) trackGTIDs(reader *mysql.PacketReader) error {
+	if !p.status.SessionTrack() {
+		log.Println("Client does not support CLIENT_SESSION_TRACK, reads after writes stay on main for", p.consistency.window)
+		return nil
+	}
+	log.Println("Track GTIDs: SET SESSION session_track_gtids = OWN_GTID")
+	query := append([]byte{mysql.ComQuery}, "SET SESSION session_track_gtids = OWN_GTID"...)
+	_, err := p.remoteConn.Write(mysql.NewPacket(0, query).Raw)
+	if err != nil {
+		return err
+	}
+	pkt, err := reader.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if pkt.IsError() {
+		log.Println("Main server does not track GTIDs, reads after writes stay on it for", p.consistency.window)
+	}
+	return nil
 }
 
 func initMysqlDB(conf config.Proxy) ([]WeightedMysqlDB, int) {
@@ -210,12 +716,10 @@ func initMysqlDB(conf config.Proxy) ([]WeightedMysqlDB, int) {
 		if secondary.Weight <= 0 {
 			continue
 		}
-		dsn := fmt.Sprintf("%s:%s@(%s:%d)/%s",
-			secondary.User, secondary.Password, secondary.Host, secondary.Port, secondary.DbName)
-		connector, err := mysql.CreateConnector(dsn)
+		connector, err := newMysqlConnector(secondary)
 		if err != nil {
-			log.Println("Can NOT open Secondary DB", secondary.Name, "of Proxy", conf.Name, err)
-			continue
+			log.Fatalln("Invalid options of Secondary DB", secondary.Name, "of Proxy", conf.Name, err)
+			return nil, 0
 		}
 		min := 1
 		max := 10
@@ -231,13 +735,10 @@ func initMysqlDB(conf config.Proxy) ([]WeightedMysqlDB, int) {
 		}
 
 		connPool := pool.NewConnectionPool(connector, min, max, lifeTime)
-		dbs = append(dbs, WeightedMysqlDB{Name: secondary.Name, Db: connPool, Weight: secondary.Weight})
+		dbs = append(dbs, WeightedMysqlDB{Name: secondary.Name, Group: secondary.Group, Db: connPool, Weight: secondary.Weight,
+			lag: newMysqlLagProbe(connPool), dbName: secondary.DbName,
+			databases: newMysqlPools(secondary.Name, connector, min, max, lifeTime)})
 		total += secondary.Weight
 	}
 	return dbs, total
 }
-
-func initRegexp() []*regexp.Regexp {
-	pattern := []string{`(?i)^(select)`, `(?i)^(begin|start transaction)`, `(?i)^(commit|rollback)`}
-	return []*regexp.Regexp{regexp.MustCompile(pattern[0]), regexp.MustCompile(pattern[1]), regexp.MustCompile(pattern[2])}
-}
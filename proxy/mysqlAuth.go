@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"dbrwproxy/mysql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// ER_ACCESS_DENIED_ERROR
+	erAccessDenied = 1045
+	// SQLSTATE class 28, invalid authorization specification
+	sqlStateAuthorization = "28000"
+)
+
+// login authenticates the client against the user list with a greeting of
+// the proxy's own, then logs in to the main server with the credentials
+// the user maps to. local and remote read the client and the main server,
+// the readers returned the connections as they are after the handshake.
+func (p *MysqlProxy) login(local, remote *mysql.PacketReader) (*mysql.PacketReader, *mysql.PacketReader, error) {
+	greeting, err := p.readGreeting(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the greeting of the main server, with a scramble of the proxy
+	scramble, err := mysql.NewScramble()
+	if err != nil {
+		return nil, nil, err
+	}
+	own := *greeting
+	own.Capabilities &^= mysql.ClientSSL | mysql.ClientCompress
+	if p.tls.config != nil {
+		own.Capabilities |= mysql.ClientSSL
+	}
+	own.AuthData, own.AuthPlugin = scramble, p.users.method
+	response, local, _, err := p.greet(&own, local)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth := response.AuthResponse
+	if response.AuthPlugin != p.users.method {
+		switchRequest := mysql.AuthSwitchRequest(p.users.method, scramble)
+		if _, err = mysql.WritePacket(p.localConn, local.Sequence()+1, switchRequest); err != nil {
+			return nil, nil, err
+		}
+		pkt, err := local.ReadPacket()
+		if err != nil {
+			return nil, nil, err
+		}
+		auth = pkt.Payload
+	}
+	next := local.Sequence() + 1
+	user, known := p.users.users[response.User]
+	if !known || !mysql.CheckScramble(p.users.method, scramble, auth, user.Password) {
+		p.writeAccessDenied(next, response.User, len(auth) > 0)
+		return nil, nil, fmt.Errorf("access denied for user %s from %s", response.User, p.localConn.RemoteAddr())
+	}
+	if p.users.method == mysql.CachingSHA2Password {
+		if _, err = mysql.WritePacket(p.localConn, next, mysql.FastAuthSuccess); err != nil {
+			return nil, nil, err
+		}
+		next++
+	}
+
+	// log in to the main server as the client would have
+	main := mainCredentials(user)
+	plugin := greeting.AuthPlugin
+	if plugin != mysql.CachingSHA2Password {
+		// the server asks to switch if the user has another plugin
+		plugin = mysql.NativePassword
+	}
+	login := *response
+	login.Capabilities &= own.Capabilities &^ mysql.ClientSSL
+	login.User, login.AuthPlugin = main.User, plugin
+	if login.AuthResponse, err = mysql.ScramblePassword(plugin, greeting.AuthData, main.Password); err != nil {
+		return nil, nil, err
+	}
+	remote, secure, err := p.dialTLS(greeting, &login, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = p.writeLogin(&login, secure); err != nil {
+		return nil, nil, err
+	}
+	result, err := mysql.Authenticate(p.remoteConn, remote, greeting.AuthData, plugin, main.Password, secure)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = p.endLogin(result, remote, next); err != nil {
+		return nil, nil, fmt.Errorf("%v as %s", err, main.User)
+	}
+	p.client.user, p.client.database = response.User, response.Database
+	p.client.secondary = secondaryCredentials(user)
+	return local, remote, nil
+}
+
+// relayLogin answers the SSL request of the client itself, then relays
+// its authentication with the main server. The connection to the main
+// server is encrypted if the client's is and the server supports it.
+func (p *MysqlProxy) relayLogin(local, remote *mysql.PacketReader) (*mysql.PacketReader, *mysql.PacketReader, error) {
+	greeting, err := p.readGreeting(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	own := *greeting
+	own.Capabilities = own.Capabilities&^mysql.ClientCompress | mysql.ClientSSL
+	response, local, clientTLS, err := p.greet(&own, local)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.client.user, p.client.database = response.User, response.Database
+
+	response.Capabilities &^= mysql.ClientSSL
+	secure := false
+	if clientTLS && p.mainTLS.config != nil {
+		if remote, secure, err = p.dialTLS(greeting, response, remote); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = p.writeLogin(response, secure); err != nil {
+		return nil, nil, err
+	}
+	next := local.Sequence() + 1
+	plugin, scramble := response.AuthPlugin, greeting.AuthData
+	for {
+		pkt, err := remote.ReadPacket()
+		if err != nil {
+			return nil, nil, err
+		}
+		request := pkt.Payload
+		if len(request) == 0 {
+			return nil, nil, mysql.ErrMalformPkt
+		}
+		switch request[0] {
+		case mysql.PacketOK, mysql.PacketERR:
+			if err = p.endLogin(pkt, remote, next); err != nil {
+				return nil, nil, fmt.Errorf("%v as %s", err, response.User)
+			}
+			return local, remote, nil
+		case mysql.PacketAuthSwitch:
+			plugin, scramble = mysql.ParseAuthSwitch(request)
+		}
+		if _, err = mysql.WritePacket(p.localConn, next, request); err != nil {
+			return nil, nil, err
+		}
+		if bytes.Equal(request, mysql.FastAuthSuccess) {
+			// the OK packet follows
+			next++
+			continue
+		}
+		if pkt, err = local.ReadPacket(); err != nil {
+			return nil, nil, err
+		}
+		next = local.Sequence() + 1
+		reply := pkt.Payload
+		if clientTLS && !secure && plugin == mysql.CachingSHA2Password &&
+			bytes.Equal(request, mysql.FullAuthenticationRequest) {
+			// the client sent its password in clear over TLS, the
+			// server expects it encrypted with its public key
+			password := strings.TrimSuffix(string(reply), "\x00")
+			reply, err = mysql.PublicKeyPassword(p.remoteConn, remote, remote.Sequence()+1, scramble, password)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if _, err = mysql.WritePacket(p.remoteConn, remote.Sequence()+1, reply); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// readGreeting reads the greeting of the main server.
+func (p *MysqlProxy) readGreeting(remote *mysql.PacketReader) (*mysql.Greeting, error) {
+	pkt, err := remote.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if pkt.IsError() {
+		// the main server refuses connections, such as when it has too many
+		p.localConn.Write(pkt.Raw)
+		return nil, errors.New("main server refused the connection")
+	}
+	greeting, err := mysql.ParseGreeting(pkt.Payload)
+	if err != nil {
+		return nil, err
+	}
+	p.status.Response(pkt)
+	return greeting, nil
+}
+
+// greet sends greeting to the client and reads its handshake response,
+// upgrading the connection to TLS first if the client asks for it. It
+// returns the reader of the connection and whether it is encrypted.
+func (p *MysqlProxy) greet(greeting *mysql.Greeting, local *mysql.PacketReader) (*mysql.HandshakeResponse, *mysql.PacketReader, bool, error) {
+	if _, err := mysql.WritePacket(p.localConn, 0, greeting.Payload()); err != nil {
+		return nil, nil, false, err
+	}
+	pkt, err := local.ReadPacket()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	secure := pkt.IsSSLRequest()
+	if secure {
+		if p.tls.config == nil {
+			return nil, nil, false, errors.New("client asked for TLS, which was not offered")
+		}
+		// the client may have sent its hello along with the request
+		conn := tls.Server(bufferedConn{p.localConn, local}, p.tls.config)
+		if err = conn.Handshake(); err != nil {
+			return nil, nil, false, err
+		}
+		p.localConn = conn
+		local = mysql.NewPacketReader(conn)
+		if pkt, err = local.ReadPacket(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	response, err := mysql.ReadHandshakeResponse(pkt.Payload)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err = p.tls.check(p.localConn, response.User); err != nil {
+		p.writeAccessDenied(local.Sequence()+1, response.User, len(response.AuthResponse) > 0)
+		return nil, nil, false, err
+	}
+	return response, local, secure, nil
+}
+
+// dialTLS upgrades the connection to the main server to TLS with the
+// capabilities of response, as configured and as far as the server
+// supports it. It returns the reader of the connection and whether it is
+// encrypted.
+func (p *MysqlProxy) dialTLS(greeting *mysql.Greeting, response *mysql.HandshakeResponse,
+	remote *mysql.PacketReader) (*mysql.PacketReader, bool, error) {
+	if p.mainTLS.config == nil {
+		return remote, false, nil
+	}
+	if greeting.Capabilities&mysql.ClientSSL == 0 {
+		if p.mainTLS.required {
+			return nil, false, errors.New("main server does not support TLS")
+		}
+		return remote, false, nil
+	}
+	request := *response
+	request.Capabilities |= mysql.ClientSSL
+	pkt := mysql.NewPacket(1, request.SSLRequest())
+	p.status.Command(pkt)
+	if _, err := p.remoteConn.Write(pkt.Raw); err != nil {
+		return nil, false, err
+	}
+	conn := tls.Client(bufferedConn{p.remoteConn, remote}, p.mainTLS.config)
+	if err := conn.Handshake(); err != nil {
+		return nil, false, err
+	}
+	p.remoteConn = conn
+	return mysql.NewPacketReader(conn), true, nil
+}
+
+// writeLogin sends the handshake response to the main server, after the
+// SSL request if the connection is encrypted.
+func (p *MysqlProxy) writeLogin(response *mysql.HandshakeResponse, secure bool) error {
+	var sequence byte = 1
+	if secure {
+		response.Capabilities |= mysql.ClientSSL
+		sequence = 2
+	}
+	pkt := mysql.NewPacket(sequence, response.Payload())
+	p.status.Command(pkt)
+	_, err := p.remoteConn.Write(pkt.Raw)
+	return err
+}
+
+// endLogin relays the OK or ERR packet ending the authentication with the
+// main server to the client with sequence id sequence.
+func (p *MysqlProxy) endLogin(result *mysql.Packet, remote *mysql.PacketReader, sequence byte) error {
+	authenticated := p.status.Response(result)
+	if authenticated && p.consistency.mode == consistencyCausal {
+		// before the client can send a command
+		if err := p.trackGTIDs(remote); err != nil {
+			return err
+		}
+	}
+	if _, err := mysql.WritePacket(p.localConn, sequence, result.Payload); err != nil {
+		return err
+	}
+	if !authenticated {
+		return errors.New("main server rejected the login")
+	}
+	return nil
+}
+
+// writeAccessDenied answers a client failing to authenticate with an ERR
+// packet, as the server would.
+func (p *MysqlProxy) writeAccessDenied(sequence byte, user string, usingPassword bool) error {
+	using := "NO"
+	if usingPassword {
+		using = "YES"
+	}
+	host, _, _ := net.SplitHostPort(p.localConn.RemoteAddr().String())
+	me := &mysql.MySQLError{
+		Number:  erAccessDenied,
+		Message: fmt.Sprintf("Access denied for user '%s'@'%s' (using password: %s)", user, host, using),
+	}
+	copy(me.SQLState[:], sqlStateAuthorization)
+	return mysql.WriteErrorPacket(p.localConn, sequence, me)
+}
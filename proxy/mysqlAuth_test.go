@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"dbrwproxy/config"
+	"dbrwproxy/mysql"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestMysqlLoginRejects(t *testing.T) {
+	users := map[string]config.User{"app": {Name: "app", Password: "secret"}}
+	tests := []struct {
+		name     string
+		method   string
+		user     string
+		password string
+	}{
+		{name: "caching_sha2_password wrong password", method: mysql.CachingSHA2Password, user: "app", password: "guess"},
+		{name: "caching_sha2_password unknown user", method: mysql.CachingSHA2Password, user: "nobody", password: "secret"},
+		{name: "mysql_native_password wrong password", method: mysql.NativePassword, user: "app", password: "guess"},
+		{name: "mysql_native_password unknown user", method: mysql.NativePassword, user: "nobody", password: "secret"},
+		{name: "unknown user without password", method: mysql.NativePassword, user: "nobody"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, local := net.Pipe()
+			defer client.Close()
+			main, remote := net.Pipe()
+			defer main.Close()
+			p := &MysqlProxy{
+				localConn:  local,
+				remoteConn: remote,
+				users:      &userList{method: tt.method, users: users},
+				status:     mysql.NewStatusTracker(),
+			}
+			go func() {
+				scramble, _ := mysql.NewScramble()
+				greeting := mysql.Greeting{
+					ProtocolVersion: 10,
+					ServerVersion:   "8.0.36",
+					Capabilities:    0xffffffff,
+					Status:          2,
+					AuthData:        scramble,
+					AuthPlugin:      mysql.CachingSHA2Password,
+				}
+				mysql.WritePacket(main, 0, greeting.Payload())
+			}()
+			done := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				_, _, err := p.login(mysql.NewPacketReader(local), mysql.NewPacketReader(remote))
+				done <- err
+			}()
+
+			reader := mysql.NewPacketReader(client)
+			pkt, err := reader.ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			greeting, err := mysql.ParseGreeting(pkt.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if greeting.AuthPlugin != tt.method {
+				t.Fatalf("greeting asks for %s, want %s", greeting.AuthPlugin, tt.method)
+			}
+			response := mysql.HandshakeResponse{
+				Capabilities:  greeting.Capabilities,
+				MaxPacketSize: 1 << 24,
+				User:          tt.user,
+				AuthPlugin:    greeting.AuthPlugin,
+			}
+			if tt.password != "" {
+				if response.AuthResponse, err = mysql.ScramblePassword(tt.method, greeting.AuthData, tt.password); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err = mysql.WritePacket(client, 1, response.Payload()); err != nil {
+				t.Fatal(err)
+			}
+			if pkt, err = reader.ReadPacket(); err != nil {
+				t.Fatal(err)
+			}
+			if !pkt.IsError() || binary.LittleEndian.Uint16(pkt.Payload[1:3]) != erAccessDenied {
+				t.Errorf("client got %q, want ER_ACCESS_DENIED_ERROR", pkt.Payload)
+			}
+			if err = <-done; err == nil {
+				t.Error("login succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"dbrwproxy/mysql"
+	"encoding/binary"
+	"io"
+	"log"
+)
+
+// mysqlStatement is a statement the client prepared on the main server,
+// known by the id the main server assigned. Read-only statements are
+// prepared again on secondaries when they are executed there.
+type mysqlStatement struct {
+	query      string
+	hints      classifier.Hints
+	paramCount int
+	// paramTypes holds the parameter types of the last execution that
+	// sent them, since clients only send them when they change.
+	paramTypes []byte
+	// longData is set while parameter data sent with
+	// COM_STMT_SEND_LONG_DATA is waiting on the main server.
+	longData bool
+}
+
+// cursorTypeMask covers the COM_STMT_EXECUTE flags that open a cursor,
+// whose rows are fetched later on the same connection.
+const cursorTypeMask = 0x0f
+
+// pendingPrepare is a statement sent to the main server with
+// COM_STMT_PREPARE that it has not answered yet.
+type pendingPrepare struct {
+	query string
+	hints classifier.Hints
+}
+
+// trackPrepare records the statement the main server is about to prepare
+// for the client, see capturePrepare.
+func (p *MysqlProxy) trackPrepare(pkt *mysql.Packet) {
+	hints, query := p.hints(string(pkt.Payload[1:]))
+	if len(query) != len(pkt.Payload)-1 {
+		*pkt = *mysql.NewPacket(pkt.Sequence, append([]byte{mysql.ComStmtPrepare}, query...))
+	}
+	p.stmtMu.Lock()
+	p.pendingPrepares = append(p.pendingPrepares, pendingPrepare{query, hints})
+	p.stmtMu.Unlock()
+}
+
+// capturePrepare reads the statement id and parameter count from the main
+// server's response to COM_STMT_PREPARE. Clients may send several before
+// reading the responses, which come in the same order.
+func (p *MysqlProxy) capturePrepare(pkt *mysql.Packet) {
+	if !p.status.Preparing() {
+		return
+	}
+	p.stmtMu.Lock()
+	defer p.stmtMu.Unlock()
+	if len(p.pendingPrepares) == 0 {
+		return
+	}
+	pending := p.pendingPrepares[0]
+	p.pendingPrepares = p.pendingPrepares[1:]
+	if len(pkt.Payload) >= 9 && pkt.Payload[0] == 0x00 {
+		id := binary.LittleEndian.Uint32(pkt.Payload[1:5])
+		p.statements[id] = &mysqlStatement{
+			query:      pending.query,
+			hints:      pending.hints,
+			paramCount: int(binary.LittleEndian.Uint16(pkt.Payload[7:9])),
+		}
+	}
+}
+
+func (p *MysqlProxy) statement(pkt *mysql.Packet) *mysqlStatement {
+	if len(pkt.Payload) < 5 {
+		return nil
+	}
+	p.stmtMu.Lock()
+	defer p.stmtMu.Unlock()
+	return p.statements[binary.LittleEndian.Uint32(pkt.Payload[1:5])]
+}
+
+// setLongData records whether parameter data of stmt, if known, is waiting
+// on the main server.
+func (p *MysqlProxy) setLongData(stmt *mysqlStatement, longData bool) {
+	if stmt == nil {
+		return
+	}
+	p.stmtMu.Lock()
+	stmt.longData = longData
+	p.stmtMu.Unlock()
+}
+
+// delegateStmt handles the prepared statement commands. Everything is
+// forwarded to the main server except executions of read-only statements
+// outside a transaction, which run on a secondary, and executions in a
+// read-only transaction, which run on its pinned connection.
+func (p *MysqlProxy) delegateStmt(pkt *mysql.Packet) (bool, error) {
+	switch pkt.Command() {
+	case mysql.ComStmtPrepare:
+		p.trackPrepare(pkt)
+		return false, nil
+	case mysql.ComStmtSendLongData:
+		p.setLongData(p.statement(pkt), true)
+		return false, nil
+	case mysql.ComStmtReset:
+		p.setLongData(p.statement(pkt), false)
+		return false, nil
+	case mysql.ComStmtClose:
+		if len(pkt.Payload) >= 5 {
+			p.stmtMu.Lock()
+			delete(p.statements, binary.LittleEndian.Uint32(pkt.Payload[1:5]))
+			p.stmtMu.Unlock()
+		}
+		return false, nil
+	}
+
+	stmt := p.statement(pkt)
+	if stmt == nil || len(pkt.Payload) < 10 {
+		return false, nil
+	}
+	payload := stmt.bindParamTypes(pkt.Payload)
+	p.stmtMu.Lock()
+	longData := stmt.longData
+	p.stmtMu.Unlock()
+	if p.pinned != nil {
+		switch {
+		case longData:
+			return true, p.writeNotSupported(pkt.Sequence+1, "parameters sent as long data", "in a read-only transaction on a secondary")
+		case pkt.Payload[5]&cursorTypeMask != 0:
+			return true, p.writeNotSupported(pkt.Sequence+1, "cursor", "in a read-only transaction on a secondary")
+		}
+		err := p.executeOnSecondary(p.pinned, stmt, payload, pkt.Sequence+1)
+		return true, p.endPinned(pkt.Sequence, err, false)
+	}
+	weighted, rt := p.route(stmt.query, stmt.hints)
+	if rt.reject != nil {
+		return true, p.writeReject(pkt.Sequence+1, rt.reject)
+	}
+	switch {
+	case weighted == nil:
+	case rt.pin:
+		log.Println("Choose main instead: transaction started by a prepared statement")
+		weighted = nil
+	case longData:
+		log.Println("Choose main instead: parameters sent as long data")
+		weighted = nil
+	case pkt.Payload[5]&cursorTypeMask != 0:
+		log.Println("Choose main instead: cursor requested")
+		weighted = nil
+	}
+	if weighted == nil {
+		p.setLongData(stmt, false)
+		log.Println("Execute SQL -> [" + stmt.query + "]")
+		return false, nil
+	}
+
+	db := weighted.poolFor(&p.client)
+	conn, err := db.Get()
+	if err != nil {
+		log.Println("Secondary connection failed:", err)
+		return true, p.writeError(pkt.Sequence+1, err)
+	}
+	if err = p.configure(conn); err != nil {
+		log.Println("Choose main instead: session settings failed on", weighted.Name, err)
+		db.Put(conn)
+		log.Println("Execute SQL -> [" + stmt.query + "]")
+		return false, nil
+	}
+	defer db.Put(conn)
+	if _, err = conn.Prepare1(stmt.query); err != nil {
+		// the main server reports the error if it has it as well
+		log.Println("Choose main instead: prepare failed on", weighted.Name, err)
+		log.Println("Execute SQL -> [" + stmt.query + "]")
+		return false, nil
+	}
+	err = p.executeOnSecondary(conn, stmt, payload, pkt.Sequence+1)
+	if err != nil {
+		log.Println("Secondary query failed:", err)
+		if _, ok := err.(*mysql.MySQLError); !ok {
+			// server errors have already been relayed as they were read
+			sequence := conn.Sequence()
+			if sequence == 0 {
+				// the statement was never executed
+				sequence = pkt.Sequence + 1
+			}
+			return true, p.writeError(sequence, err)
+		}
+	}
+	return true, nil
+}
+
+// executeOnSecondary prepares stmt on conn unless it already is, then
+// executes it and relays the results, sequence being the sequence id the
+// client expects next.
+func (p *MysqlProxy) executeOnSecondary(conn *mysql.MysqlConn, stmt *mysqlStatement, payload []byte, sequence byte) error {
+	log.Println("Execute SQL -> [" + stmt.query + "]")
+	replicaStmt, err := conn.Prepare1(stmt.query)
+	if err != nil {
+		if me, ok := err.(*mysql.MySQLError); ok {
+			// unlike those of the execution, it was not relayed as read
+			if err := mysql.WriteErrorPacket(p.localConn, sequence, me); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	rows, err := replicaStmt.Query1(payload, p.localConn)
+	if err != nil {
+		return err
+	}
+	for {
+		err = rows.Next1(p.localConn)
+		if err == io.EOF {
+			if !rows.HasNextResultSet() {
+				return nil
+			}
+			err = rows.NextResultSet1(p.localConn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// bindParamTypes returns the COM_STMT_EXECUTE payload with the parameter
+// types included. The main server remembers the types a client sent with
+// an earlier execution, a secondary that did not see it does not.
+func (stmt *mysqlStatement) bindParamTypes(payload []byte) []byte {
+	if stmt.paramCount == 0 {
+		return payload
+	}
+	// command, statement id, flags, iteration count, NULL bitmap
+	pos := 1 + 4 + 1 + 4 + (stmt.paramCount+7)/8
+	if len(payload) <= pos {
+		return payload
+	}
+	typesEnd := pos + 1 + 2*stmt.paramCount
+	if payload[pos] == 1 {
+		if len(payload) >= typesEnd {
+			stmt.paramTypes = append(stmt.paramTypes[:0], payload[pos+1:typesEnd]...)
+		}
+		return payload
+	}
+	if stmt.paramTypes == nil {
+		return payload
+	}
+	bound := make([]byte, 0, len(payload)+len(stmt.paramTypes))
+	bound = append(bound, payload[:pos]...)
+	bound = append(bound, 1)
+	bound = append(bound, stmt.paramTypes...)
+	return append(bound, payload[pos+1:]...)
+}
@@ -1,18 +1,20 @@
 package proxy
 
 import (
-	"database/sql"
+	"crypto/tls"
+	"dbrwproxy/classifier"
 	"dbrwproxy/config"
+	"dbrwproxy/pool"
+	"dbrwproxy/postgres"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5/pgproto3"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
 	"io"
 	"log"
 	"math/rand"
 	"net"
-	"regexp"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,12 +22,61 @@ var PostgresDBs []WeightedDB
 
 type PostgresProxy struct {
 	localAddr, remoteAddr *net.TCPAddr
-	localConn, remoteConn *net.TCPConn
+	localConn, remoteConn net.Conn
 	dbs                   []WeightedDB
 	totalWeight           int
-	regex                 []*regexp.Regexp
+	backend               *pgproto3.Backend
+	frontend              *pgproto3.Frontend
+	localMu               sync.Mutex
+	classifier            *classifier.Classifier
+	stripHints            bool
+	rules                 []*rule
+	client                clientInfo
 	exit                  bool
-	inTrans               bool
+	// users authenticates clients at the proxy, nil if they authenticate
+	// with the main server.
+	users *userList
+	// tls is how the proxy secures clients asking for TLS, without a
+	// configuration if they are asked to go on in plain, mainTLS how it
+	// connects to the main server.
+	tls     listenerTLS
+	mainTLS backendTLS
+	// mainOptions holds the timeouts of connections to the main server.
+	mainOptions config.Connection
+	// txStatus is the transaction status of the last ReadyForQuery from the
+	// main server, guarded by mainMu.
+	txStatus byte
+	// consistency follows the writes of the session to read them back.
+	consistency stickiness
+	// state pins the session to the main server while it holds
+	// session-scoped state there.
+	state sessionState
+	// settings are set on the secondary connections reads run on.
+	settings sessionSettings
+	// pinned is the secondary connection running the read-only transaction
+	// of the session.
+	pinned   *postgres.PostgresConn
+	pinnedDB *WeightedDB
+	// replayedLSN holds the WAL position each secondary was last seen to
+	// have replayed, for causal reads.
+	replayedLSN map[string]uint64
+	// lsn receives the result of the hidden query for the WAL position of
+	// the main server while it runs, guarded by mainMu.
+	lsn      chan string
+	lsnValue string
+
+	// extended query protocol state, see delegateExtended
+	statements     map[string]*pgStatement
+	mainStatements map[string]*pgStatement
+	portals        map[string]*pgStatement
+	pending        []pgMessage
+	batchOnMain    bool
+	mainMu         sync.Mutex
+	hiddenParses   []int
+	hiddenCloses   []int
+	// mainCloses are the statements the client closed in a read-only
+	// transaction on a secondary, still to be closed on the main server.
+	mainCloses []string
 }
 
 func StartPostgres(conf config.Proxy) {
@@ -51,6 +102,40 @@ func StartPostgres(conf config.Proxy) {
 		return
 	}
 	PostgresDBs = dbs
+	cls := classifier.New(classifier.PostgreSQL, conf.MainFunctions)
+	secondaries := make(map[string]string)
+	for _, db := range dbs {
+		secondaries[db.Name] = db.Group
+	}
+	rules, err := compileRules(conf.Rules, secondaries)
+	if err != nil {
+		log.Fatalln("Invalid rules of Proxy", conf.Name, err)
+		return
+	}
+	consistency, err := newStickiness(conf.Consistency, conf.ConsistencyWindow, conf.CausalWait)
+	if err != nil {
+		log.Fatalln("Invalid consistency of Proxy", conf.Name, err)
+		return
+	}
+	users, err := newUserList(conf, postgresAuthMethods)
+	if err != nil {
+		log.Fatalln("Invalid users of Proxy", conf.Name, err)
+		return
+	}
+	clientTLS, err := serverTLS(conf.Server)
+	if err != nil {
+		log.Fatalln("Invalid TLS certificate of Proxy", conf.Name, err)
+		return
+	}
+	if err = checkMainOptions(conf.Db.Main.Connection); err != nil {
+		log.Fatalln("Invalid options of main DB of Proxy", conf.Name, err)
+		return
+	}
+	mainTLS, err := newPostgresBackendTLS(conf.Db.Main.SSLMode, conf.Db.Main.Addr, conf.Db.Main.Connection)
+	if err != nil {
+		log.Fatalln("Invalid SSLMode of main DB of Proxy", conf.Name, err)
+		return
+	}
 	log.Println("PostgreSQL Proxy listening on", conf.Server.ProxyAddr)
 
 	for {
@@ -61,42 +146,221 @@ func StartPostgres(conf config.Proxy) {
 		}
 
 		p := &PostgresProxy{
-			localConn:   conn,
-			localAddr:   localAddr,
-			remoteAddr:  remoteAddr,
-			dbs:         dbs,
-			totalWeight: totalWeight,
+			localConn:      conn,
+			localAddr:      localAddr,
+			remoteAddr:     remoteAddr,
+			dbs:            dbs,
+			totalWeight:    totalWeight,
+			classifier:     cls,
+			consistency:    consistency,
+			stripHints:     conf.StripHints,
+			rules:          rules,
+			users:          users,
+			tls:            clientTLS,
+			mainOptions:    conf.Db.Main.Connection,
+			mainTLS:        mainTLS,
+			client:         clientInfo{addr: conn.RemoteAddr().(*net.TCPAddr).IP},
+			state:          newSessionState(conn.RemoteAddr().String()),
+			txStatus:       'I',
+			statements:     make(map[string]*pgStatement),
+			mainStatements: make(map[string]*pgStatement),
+			portals:        make(map[string]*pgStatement),
+			hiddenParses:   []int{0},
+			hiddenCloses:   []int{0},
+			replayedLSN:    make(map[string]uint64),
 		}
-		p.regex = initRegexp()
 		go p.service()
 	}
 }
 
 func (p *PostgresProxy) service() {
 	defer p.localConn.Close()
-	conn, err := net.DialTCP("tcp", nil, p.remoteAddr)
+	conn, err := dialMain(p.remoteAddr, p.mainOptions)
 	if err != nil {
-		log.Printf("Remote connection failed:", err)
+		log.Println("Remote connection failed:", err)
 		return
 	}
 	p.remoteConn = conn
 	defer p.remoteConn.Close()
+	p.backend = pgproto3.NewBackend(p.localConn, p.localConn)
+	p.frontend = pgproto3.NewFrontend(p.remoteConn, p.remoteConn)
+	if err = p.startup(); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Println("Startup failed:", err)
+		}
+		return
+	}
 	go p.handleOutbound()
 	p.handleInbound()
+	p.unpin()
 	p.exit = true
 }
 
+// startup handles the untyped messages a client may open the connection
+// with, then authenticates the client against the user list, or relays the
+// authentication exchange in lockstep so that the password messages can be
+// decoded according to the requested method.
+func (p *PostgresProxy) startup() error {
+	for {
+		msg, err := p.backend.ReceiveStartupMessage()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.SSLRequest:
+			if p.tls.config == nil {
+				// routing needs the traffic in clear text, ask the client to go on without encryption
+				if _, err = p.localConn.Write([]byte{'N'}); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err = p.localConn.Write([]byte{'S'}); err != nil {
+				return err
+			}
+			// the client waits for the answer, nothing is buffered yet
+			conn := tls.Server(p.localConn, p.tls.config)
+			if err = conn.Handshake(); err != nil {
+				return err
+			}
+			p.localConn = conn
+			p.backend = pgproto3.NewBackend(conn, conn)
+		case *pgproto3.GSSEncRequest:
+			// GSSAPI encryption is not supported, the client may ask for TLS next
+			if _, err = p.localConn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case *pgproto3.CancelRequest:
+			p.frontend.Send(msg)
+			return p.frontend.Flush()
+		case *pgproto3.StartupMessage:
+			p.client.user = msg.Parameters["user"]
+			p.client.database = msg.Parameters["database"]
+			if p.client.database == "" {
+				p.client.database = p.client.user
+			}
+			p.settings.update(startupSettings(msg.Parameters))
+			if err = p.tls.check(p.localConn, p.client.user); err != nil {
+				p.send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28000", Message: err.Error()})
+				return err
+			}
+			if err = p.dialTLS(); err != nil {
+				return err
+			}
+			if p.users != nil {
+				return p.login(msg)
+			}
+			p.frontend.Send(msg)
+			if err = p.frontend.Flush(); err != nil {
+				return err
+			}
+			return p.authenticate()
+		}
+	}
+}
+
+// dialTLS upgrades the connection to the main server to TLS, as configured
+// and as far as the server supports it.
+func (p *PostgresProxy) dialTLS() error {
+	if p.mainTLS.config == nil {
+		return nil
+	}
+	conn, err := postgres.StartTLS(p.remoteConn, p.mainTLS.config, p.mainTLS.required)
+	if err != nil {
+		return fmt.Errorf("TLS with main server failed: %v", err)
+	}
+	p.remoteConn = conn
+	p.frontend = pgproto3.NewFrontend(conn, conn)
+	return nil
+}
+
+func (p *PostgresProxy) authenticate() error {
+	for {
+		msg, err := p.frontend.Receive()
+		if err != nil {
+			return err
+		}
+		if sasl, ok := msg.(*pgproto3.AuthenticationSASL); ok {
+			// channel binding would bind to the certificate of the proxy,
+			// not to the one of the main server
+			var mechanisms []string
+			for _, mechanism := range sasl.AuthMechanisms {
+				if !strings.HasSuffix(mechanism, "-PLUS") {
+					mechanisms = append(mechanisms, mechanism)
+				}
+			}
+			sasl.AuthMechanisms = mechanisms
+		}
+		if err = p.send(msg); err != nil {
+			return err
+		}
+		var authType uint32
+		switch msg := msg.(type) {
+		case *pgproto3.AuthenticationCleartextPassword:
+			authType = pgproto3.AuthTypeCleartextPassword
+		case *pgproto3.AuthenticationMD5Password:
+			authType = pgproto3.AuthTypeMD5Password
+		case *pgproto3.AuthenticationGSS:
+			authType = pgproto3.AuthTypeGSS
+		case *pgproto3.AuthenticationGSSContinue:
+			authType = pgproto3.AuthTypeGSSCont
+		case *pgproto3.AuthenticationSASL:
+			authType = pgproto3.AuthTypeSASL
+		case *pgproto3.AuthenticationSASLContinue:
+			authType = pgproto3.AuthTypeSASLContinue
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("main server rejected the connection: %s", msg.Message)
+		case *pgproto3.ReadyForQuery:
+			p.txStatus = msg.TxStatus
+			return nil
+		default:
+			continue
+		}
+		if err = p.backend.SetAuthType(authType); err != nil {
+			return err
+		}
+		reply, err := p.backend.Receive()
+		if err != nil {
+			return err
+		}
+		p.frontend.Send(reply)
+		if err = p.frontend.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// send writes backend messages to the client. Both the outbound relay and
+// locally answered queries write to the client, so writes are serialized.
+func (p *PostgresProxy) send(msgs ...pgproto3.BackendMessage) error {
+	var buf []byte
+	for _, msg := range msgs {
+		buf = msg.Encode(buf)
+	}
+	return p.write(buf)
+}
+
+func (p *PostgresProxy) write(buf []byte) error {
+	p.localMu.Lock()
+	defer p.localMu.Unlock()
+	_, err := p.localConn.Write(buf)
+	return err
+}
+
 func (p *PostgresProxy) handleInbound() {
-	buff := make([]byte, 65535)
 	for {
-		n, err := p.localConn.Read(buff)
+		msg, err := p.backend.Receive()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
 				log.Println("Read local failed:", err)
 			}
 			return
 		}
-		flag, err := p.delegateSelect(buff[:n])
+		flag, err := p.delegateSelect(msg)
+		if flag && err != nil {
+			log.Println("Write failed:", err)
+			return
+		}
 		if !flag {
 			if err != nil {
 				log.Println(err)
@@ -106,7 +370,7 @@ func (p *PostgresProxy) handleInbound() {
 				}
 				return
 			}
-			n, err = p.remoteConn.Write(buff[0:n])
+			err = p.sendMain(p.message(msg))
 			if err != nil {
 				log.Println("Write failed:", err)
 				return
@@ -116,169 +380,480 @@ func (p *PostgresProxy) handleInbound() {
 }
 
 func (p *PostgresProxy) handleOutbound() {
-	buff := make([]byte, 65535)
+	defer p.endMainLSN()
 	for {
-		n, err := p.remoteConn.Read(buff)
+		msg, err := p.frontend.Receive()
 		if err != nil {
-			if err != io.EOF && !p.exit {
+			if err != io.ErrUnexpectedEOF && !p.exit {
 				log.Println("Read remote failed:", err)
 			}
 			return
 		}
-		if n < 1 {
+		if p.dropOutbound(msg) {
 			continue
 		}
-		n, err = p.localConn.Write(buff[0:n])
+		if ready, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			p.mainMu.Lock()
+			p.txStatus = ready.TxStatus
+			p.mainMu.Unlock()
+		}
+		err = p.send(msg)
 		if err != nil {
 			log.Println("Write failed:", err)
 			return
 		}
 	}
-	log.Println("handle outbound returned!!!")
 }
 
-func (p *PostgresProxy) delegateSelect(buffer []byte) (bool, error) {
-	if buffer[0] != 'Q' {
+func (p *PostgresProxy) delegateSelect(msg pgproto3.FrontendMessage) (bool, error) {
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute,
+		*pgproto3.Close, *pgproto3.Sync, *pgproto3.Flush:
+		return true, p.delegateExtended(msg)
+	}
+	if err := p.flushPending(); err != nil {
+		return true, err
+	}
+	query, ok := msg.(*pgproto3.Query)
+	if !ok {
 		return false, nil
 	}
-	end := len(buffer)
-	if buffer[end-1] == 0 {
-		end = end - 1
-	}
-	sql := string(buffer)[5:end]
-	matchSelect := p.regex[0].MatchString(sql)
-	if p.inTrans || !matchSelect {
-		matchTranBegin := p.regex[1].MatchString(sql)
-		if matchTranBegin {
-			p.inTrans = true
-		}
-		if p.inTrans {
-			matchTranEnd := p.regex[2].MatchString(sql)
-			if matchTranEnd {
-				p.inTrans = false
-			}
+	hints, sql := p.hints(query.String)
+	query.String = sql
+	if p.pinned != nil {
+		if verdict := p.classifier.Classify(sql); changesSession(verdict) {
+			return true, p.writeNotSupported(verdict.Reason, "in a read-only transaction on a secondary")
 		}
-		log.Println("Choose main")
+		return true, p.endPinned(p.writeDataRow(p.pinned, sql))
+	}
+	db, rt := p.route(sql, hints)
+	if rt.reject != nil {
+		return true, p.writeReject(rt.reject)
+	}
+	if db == nil {
 		log.Println("Execute SQL -> [" + sql + "]")
 		return false, nil
 	}
-	db := p.chooseByWeight()
-	p.writeDataRow(db, sql)
+	connPool := db.poolFor(&p.client)
+	conn, err := connPool.Get()
+	if err != nil {
+		log.Println("Secondary connection failed:", err)
+		return true, p.writeError(err)
+	}
+	if err = p.configure(conn); err != nil {
+		log.Println("Choose main instead: session settings failed on", db.Name, err)
+		connPool.Put(conn)
+		log.Println("Execute SQL -> [" + sql + "]")
+		return false, nil
+	}
+	if rt.pin {
+		p.pin(db, conn)
+		return true, p.endPinned(p.writeDataRow(conn, sql))
+	}
+	err = p.writeDataRow(conn, sql)
+	if conn.TxStatus() != 'I' {
+		conn.Close()
+	}
+	connPool.Put(conn)
+	if err != nil {
+		log.Println("Secondary query failed:", err)
+		return true, p.writeError(err)
+	}
 	return true, nil
 }
 
-func (p *PostgresProxy) chooseByWeight() *sqlx.DB {
-	randomNum := rand.Intn(p.totalWeight)
-	currentWeight := 0
-	for _, element := range p.dbs {
-		currentWeight += element.Weight
-		if randomNum < currentWeight {
-			log.Println("Choose", element.Name)
-			return element.Db
+// startupSettings returns the run-time parameters a client set in its
+// startup message.
+func startupSettings(params map[string]string) []classifier.Setting {
+	var settings []classifier.Setting
+	for name, value := range params {
+		switch name {
+		case "user", "database", "options", "replication":
+			continue
 		}
+		value = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+		settings = append(settings, classifier.Setting{Name: strings.ToLower(name), Value: value})
 	}
-	return p.dbs[0].Db
+	return settings
 }
 
-func (p *PostgresProxy) writeDataRow(db *sqlx.DB, query string) error {
-	log.Println("Execute SQL -> ["+query+"]", "db", db)
-	rows, err := db.Query(query)
-	if err != nil {
+// configure sets the run-time parameters of the client on a secondary
+// connection, as far as they differ.
+func (p *PostgresProxy) configure(conn *postgres.PostgresConn) error {
+	names, reset := p.settings.delta(conn.Settings)
+	if reset {
+		if err := conn.ResetSettings(); err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("SET " + name + " TO " + p.settings.values[name] + ";")
+	}
+	if err := conn.Exec(b.String()); err != nil {
 		return err
 	}
-	defer rows.Close()
+	conn.Settings = p.settings.applied(conn.Settings, names)
+	return nil
+}
+
+// pin holds conn to db for the read-only transaction starting on it.
+func (p *PostgresProxy) pin(db *WeightedDB, conn *postgres.PostgresConn) {
+	log.Println("Pin", db.Name, "for read-only transaction")
+	p.pinned, p.pinnedDB = conn, db
+}
 
-	desc, err := prepareRowDescription(rows)
+// endPinned ends a query cycle run on the pinned connection, unpinning it
+// once the read-only transaction is over.
+func (p *PostgresProxy) endPinned(err error) error {
 	if err != nil {
-		return err
+		log.Println("Secondary query failed:", err)
+		p.pinned.Close()
+		p.unpin()
+		return p.writeError(err)
+	}
+	if p.pinned.TxStatus() == 'I' {
+		p.unpin()
+	}
+	return nil
+}
+
+// unpin returns the pinned connection to its pool, closing it if it is
+// still in a transaction.
+func (p *PostgresProxy) unpin() {
+	if p.pinned == nil {
+		return
 	}
-	buf := (&pgproto3.RowDescription{Fields: desc}).Encode(nil)
-	_, err = p.localConn.Write(buf)
+	if p.pinned.TxStatus() != 'I' {
+		p.pinned.Close()
+	}
+	// the database of the session never changes
+	p.pinnedDB.poolFor(&p.client).Put(p.pinned)
+	log.Println("Unpin", p.pinnedDB.Name)
+	p.pinned, p.pinnedDB = nil, nil
+}
+
+// writeError reports a failed secondary query to the client and ends the
+// query cycle, as the main server would.
+func (p *PostgresProxy) writeError(err error) error {
+	return p.send(errorResponse(err), p.readyForQuery())
+}
+
+// readyForQuery returns the ReadyForQuery ending a query cycle answered by
+// the proxy. It reports the transaction status of the client's session,
+// which lives on the main server, not that of the secondary, unless the
+// session runs a read-only transaction on a pinned secondary connection.
+func (p *PostgresProxy) readyForQuery() *pgproto3.ReadyForQuery {
+	if p.pinned != nil {
+		return &pgproto3.ReadyForQuery{TxStatus: p.pinned.TxStatus()}
+	}
+	p.mainMu.Lock()
+	defer p.mainMu.Unlock()
+	return &pgproto3.ReadyForQuery{TxStatus: p.txStatus}
+}
+
+// hints reads the routing hints of query. The query returned is the one to
+// send, stripped of the hints if so configured.
+func (p *PostgresProxy) hints(query string) (classifier.Hints, string) {
+	hints, stripped, err := p.classifier.Hints(query)
 	if err != nil {
-		return err
+		log.Println("Ignoring routing hint:", err)
 	}
+	if p.stripHints {
+		return hints, stripped
+	}
+	return hints, query
+}
 
-	columns, err := rows.Columns()
-	cols := len(columns)
-	var count = 0
-	for rows.Next() {
-		row := make([][]byte, cols)
-		rowPtr := make([]any, cols)
-		for i := range row {
-			rowPtr[i] = &row[i]
-		}
-		err := rows.Scan(rowPtr...)
-		if err != nil {
-			return err
-		}
-		buf = (&pgproto3.DataRow{Values: row}).Encode(nil)
-		_, err = p.localConn.Write(buf)
-		if err != nil {
-			return err
+// route returns the secondary query runs on, or nil if it runs on the main
+// server or is rejected, logging why, and the routing decided.
+func (p *PostgresProxy) route(query string, hints classifier.Hints) (*WeightedDB, routing) {
+	inTrans := p.inTransaction()
+	rt := routeStatement(p.classifier, p.rules, &p.client, query, hints, inTrans, p.state.reason(),
+		p.consistency.sticky(inTrans, p.mainLSN))
+	if rt.reject != nil {
+		log.Println("Reject: rule", rt.reject.name)
+		return nil, rt
+	}
+	if rt.main {
+		log.Println("Choose main:", rt.reason)
+		p.consistency.wrote(rt.verdict)
+		p.state.update(rt.verdict.State)
+		p.settings.update(rt.verdict.Settings)
+		return nil, rt
+	}
+	return p.chooseCausal(rt.sel), rt
+}
+
+// chooseCausal chooses a secondary by sel that replayed the writes of the
+// session, waiting for one to if configured, or returns nil for the main
+// server, logging why.
+func (p *PostgresProxy) chooseCausal(sel selector) *WeightedDB {
+	sel.position = p.consistency.position
+	db := p.chooseSecondary(sel)
+	if db == nil && sel.position != "" && p.consistency.wait > 0 {
+		sel.position = ""
+		db = p.chooseSecondary(sel)
+		if db != nil && !p.replayed(db, p.consistency.position, p.consistency.wait) {
+			log.Println("Choose main:", db.Name, "did not replay WAL up to", p.consistency.position)
+			return nil
 		}
-		count++
 	}
-	buf = (&pgproto3.CommandComplete{CommandTag: []byte("SELECT " + strconv.Itoa(count))}).Encode(nil)
-	_, err = p.localConn.Write(buf)
+	if db == nil {
+		log.Println("Choose main: no secondary matches")
+	}
+	return db
+}
+
+// replayed reports whether db replayed the WAL up to lsn, waiting up to
+// wait for it to.
+func (p *PostgresProxy) replayed(db *WeightedDB, lsn string, wait time.Duration) bool {
+	position, err := parseLSN(lsn)
 	if err != nil {
-		return err
+		log.Println("Failed to check WAL position of", db.Name, err)
+		return false
+	}
+	if p.replayedLSN[db.Name] >= position {
+		return true
 	}
-	buf = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(nil)
-	_, err = p.localConn.Write(buf)
+	ok, err := postgresReplayed(db.Pool, lsn, wait)
 	if err != nil {
-		return err
+		log.Println("Failed to check WAL position of", db.Name, err)
+		return false
 	}
+	if ok {
+		p.replayedLSN[db.Name] = position
+	}
+	return ok
+}
 
-	if err = rows.Err(); err != nil {
-		return err
+// mainLSN returns the current WAL position of the main server, or "" if
+// it cannot tell. It runs a hidden query on the main server, which must
+// have answered everything the client sent it.
+func (p *PostgresProxy) mainLSN() string {
+	if p.batchOnMain {
+		return ""
 	}
-	return nil
+	ch := make(chan string, 1)
+	p.mainMu.Lock()
+	p.lsn = ch
+	p.mainMu.Unlock()
+	// a simple query replaces the unnamed statement
+	delete(p.mainStatements, "")
+	p.frontend.Send(&pgproto3.Query{String: postgresLSNQuery})
+	if err := p.frontend.Flush(); err != nil {
+		p.endMainLSN()
+	}
+	return <-ch
 }
 
-func prepareRowDescription(rows *sql.Rows) ([]pgproto3.FieldDescription, error) {
-	cols, err := rows.Columns()
-	if err != nil {
-		return nil, err
+// endMainLSN ends the hidden query for the WAL position of the main
+// server, if one runs, handing its result to mainLSN.
+func (p *PostgresProxy) endMainLSN() {
+	p.mainMu.Lock()
+	defer p.mainMu.Unlock()
+	if p.lsn != nil {
+		p.lsn <- p.lsnValue
+		p.lsn, p.lsnValue = nil, ""
 	}
-	columnTypes, err := rows.ColumnTypes()
-	if err != nil {
-		return nil, err
+}
+
+// writeReject answers a query rejected by a rule and ends the query cycle.
+func (p *PostgresProxy) writeReject(r *rule) error {
+	return p.send(&pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                "42501",
+		Message:             "dbrwproxy: statement rejected by rule " + r.name,
+	}, p.readyForQuery())
+}
+
+// writeNotSupported answers a statement the proxy cannot run where the
+// session is.
+func (p *PostgresProxy) writeNotSupported(what, where string) error {
+	return p.send(&pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                "0A000",
+		Message:             "dbrwproxy: " + what + " not supported " + where,
+	}, p.readyForQuery())
+}
+
+// changesSession reports whether a statement changes the session beyond
+// the current transaction. In a read-only transaction on a secondary, the
+// change would be made to the pinned session only, not to the main one the
+// client goes on with. SET LOCAL and cursors end with the transaction.
+func changesSession(verdict classifier.Verdict) bool {
+	if verdict.Kind != classifier.Session {
+		return false
 	}
-	columeTypeNames := make(map[string]string, len(cols))
-	for i, col := range cols {
-		columeTypeNames[col] = columnTypes[i].DatabaseTypeName()
+	switch verdict.Reason {
+	case "DECLARE", "FETCH", "MOVE", "CLOSE":
+		return false
 	}
+	return !strings.HasPrefix(verdict.Reason, "SET LOCAL")
+}
+
+// inTransaction reports whether the session has a transaction open on the
+// main server, or may have one once the main server answered the queries
+// still running there. Answering from a secondary meanwhile would also
+// reorder the responses.
+func (p *PostgresProxy) inTransaction() bool {
+	p.mainMu.Lock()
+	defer p.mainMu.Unlock()
+	return p.txStatus != 'I' || len(p.hiddenParses) > 1
+}
+
+// errorResponse converts an error met on a secondary into an ErrorResponse.
+// Errors that did not come from the server are reported as connection
+// failures.
+func errorResponse(err error) *pgproto3.ErrorResponse {
+	var pgErr *postgres.Error
+	if !errors.As(err, &pgErr) {
+		return &pgproto3.ErrorResponse{
+			Severity:            "ERROR",
+			SeverityUnlocalized: "ERROR",
+			Code:                "08006",
+			Message:             "dbrwproxy: secondary unavailable: " + err.Error(),
+		}
+	}
+	msg := pgErr.Response
+	return secondaryError(&msg)
+}
+
+// secondaryError downgrades an error that ends the secondary session, as
+// the client session it is relayed to goes on.
+func secondaryError(msg *pgproto3.ErrorResponse) *pgproto3.ErrorResponse {
+	if msg.Severity == "FATAL" || msg.Severity == "PANIC" {
+		msg.Severity = "ERROR"
+		msg.SeverityUnlocalized = "ERROR"
+	}
+	return msg
+}
+
+func (p *PostgresProxy) chooseByWeight() *WeightedDB {
+	randomNum := rand.Intn(p.totalWeight)
+	currentWeight := 0
+	for i, element := range p.dbs {
+		currentWeight += element.Weight
+		if randomNum < currentWeight {
+			log.Println("Choose", element.Name)
+			return &p.dbs[i]
+		}
+	}
+	return &p.dbs[0]
+}
+
+// chooseSecondary chooses a secondary by weight among those sel allows,
+// returning nil if there is none. Secondaries are checked for the WAL
+// position of sel in the order they are chosen, until one replayed it.
+func (p *PostgresProxy) chooseSecondary(sel selector) *WeightedDB {
+	if sel == (selector{}) {
+		return p.chooseByWeight()
+	}
+	var candidates []*WeightedDB
+	total := 0
+	for i := range p.dbs {
+		db := &p.dbs[i]
+		if sel.name != "" && db.Name != sel.name || sel.group != "" && db.Group != sel.group {
+			continue
+		}
+		if sel.maxLag > 0 {
+			lag, err := db.lag.Lag()
+			if err != nil || lag > sel.maxLag {
+				log.Println("Skip", db.Name, "replication lag", lag, err)
+				continue
+			}
+		}
+		candidates = append(candidates, db)
+		total += db.Weight
+	}
+	for len(candidates) > 0 {
+		randomNum := rand.Intn(total)
+		i := 0
+		for ; i < len(candidates)-1; i++ {
+			randomNum -= candidates[i].Weight
+			if randomNum < 0 {
+				break
+			}
+		}
+		db := candidates[i]
+		if sel.position == "" || p.replayed(db, sel.position, 0) {
+			log.Println("Choose", db.Name)
+			return db
+		}
+		log.Println("Skip", db.Name, "WAL not replayed")
+		candidates = append(candidates[:i], candidates[i+1:]...)
+		total -= db.Weight
+	}
+	return nil
+}
+
+// writeDataRow runs a simple query on a secondary and relays its responses
+// up to ReadyForQuery unchanged.
+func (p *PostgresProxy) writeDataRow(conn *postgres.PostgresConn, query string) error {
+	log.Println("Execute SQL -> [" + query + "]")
+	err := conn.Send(&pgproto3.Query{String: query})
 	if err != nil {
-		return nil, err
-	}
-	var fd []pgproto3.FieldDescription
-	for _, fieldName := range cols {
-		fieldType := columeTypeNames[fieldName]
-		var oid, size int
-		if t, ok := dataTypeLookup[fieldType]; ok {
-			oid = t.DataTypeOID
-			size = t.DataTypeSize
-		} else {
-			oid = 17
-			size = -1
-		}
-		fd = append(fd, pgproto3.FieldDescription{
-			Name:                 []byte(fieldName),
-			TableOID:             0,
-			TableAttributeNumber: 0,
-			DataTypeOID:          uint32(oid),
-			DataTypeSize:         int16(size),
-			TypeModifier:         -1,
-			Format:               0,
-		})
-	}
-	return fd, nil
+		return err
+	}
+	var out []byte
+	for {
+		msg, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.ParameterStatus:
+			// settings of the secondary session are not the client's
+			continue
+		case *pgproto3.ErrorResponse:
+			secondaryError(msg)
+		case *pgproto3.ReadyForQuery:
+			return p.write(p.readyForQuery().Encode(out))
+		}
+		out = msg.Encode(out)
+		if len(out) > 65536 {
+			if err = p.write(out); err != nil {
+				return err
+			}
+			out = out[:0]
+		}
+	}
 }
 
 type WeightedDB struct {
 	Name   string
-	Db     *sqlx.DB
+	Group  string
+	Pool   *pool.PostgresConnectionPool
 	Weight int
+	lag    *lagProbe
+	// dbName is the database Pool connects to, databases the pools to the
+	// others.
+	dbName    string
+	databases *postgresPools
+}
+
+// poolFor returns the pool of connections for the reads of client, to the
+// database it connected to with the credentials it reads with.
+func (db *WeightedDB) poolFor(client *clientInfo) *pool.PostgresConnectionPool {
+	database := client.database
+	if database == "" {
+		database = db.dbName
+	}
+	if database == db.dbName && client.secondary == nil {
+		return db.Pool
+	}
+	return db.databases.get(client.secondary, database)
+}
+
+// Close closes the pools of connections to the secondary.
+func (db *WeightedDB) Close() {
+	db.Pool.Close()
+	db.databases.close()
 }
 
 func initDB(conf config.Proxy) ([]WeightedDB, int) {
@@ -289,61 +864,30 @@ func initDB(conf config.Proxy) ([]WeightedDB, int) {
 			continue
 		}
 
-		db, err := sqlx.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s application_name=pgproxy sslmode=disable",
-			secondary.Host, secondary.Port, secondary.User, secondary.Password, secondary.DbName))
-		if err != nil {
-			log.Println("Can NOT open Secondary DB", secondary.Name, "of Proxy", conf.Name)
-			continue
-		}
+		min := 1
+		max := 10
+		lifeTime := 60 * time.Second
 		if secondary.MaxIdleConnCount > 0 {
-			db.SetMaxIdleConns(secondary.MaxIdleConnCount)
-		} else {
-			db.SetMaxIdleConns(1)
+			min = secondary.MaxIdleConnCount
 		}
 		if secondary.MaxOpenConnsCount > 0 {
-			db.SetMaxOpenConns(secondary.MaxOpenConnsCount)
-		} else {
-			db.SetMaxOpenConns(10)
+			max = secondary.MaxOpenConnsCount
 		}
 		if secondary.ConnMaxLifetime > 0 {
-			db.SetConnMaxLifetime(time.Duration(secondary.ConnMaxLifetime) * time.Second)
-		} else {
-			db.SetConnMaxLifetime(60 * time.Second)
+			lifeTime = time.Duration(secondary.ConnMaxLifetime) * time.Second
 		}
-		dbs = append(dbs, WeightedDB{Name: secondary.Name, Db: db, Weight: secondary.Weight})
+
+		cfg, err := newPostgresConfig(secondary)
+		if err != nil {
+			log.Fatalln("Invalid options of Secondary DB", secondary.Name, "of Proxy", conf.Name, err)
+			return nil, 0
+		}
+		connector := postgres.NewConnector(cfg)
+		connPool := pool.NewPostgresConnectionPool(connector, min, max, lifeTime)
+		dbs = append(dbs, WeightedDB{Name: secondary.Name, Group: secondary.Group, Pool: connPool, Weight: secondary.Weight,
+			lag: newPostgresLagProbe(connPool), dbName: secondary.DbName,
+			databases: newPostgresPools(secondary.Name, connector, min, max, lifeTime)})
 		total += secondary.Weight
 	}
 	return dbs, total
 }
-
-type pgDataType struct {
-	DataTypeOID  int
-	DataTypeSize int
-}
-
-var dataTypeLookup = makeDataTypeLookup()
-
-func makeDataTypeLookup() map[string]pgDataType {
-	return map[string]pgDataType{
-		"BOOL":     {DataTypeOID: 16, DataTypeSize: 1},
-		"BYTEA":    {DataTypeOID: 17, DataTypeSize: -1},
-		"CHAR":     {DataTypeOID: 18, DataTypeSize: 1},
-		"INT8":     {DataTypeOID: 20, DataTypeSize: 8},
-		"INT2":     {DataTypeOID: 21, DataTypeSize: 2},
-		"INT4":     {DataTypeOID: 23, DataTypeSize: 4},
-		"REGPROC":  {DataTypeOID: 24, DataTypeSize: 4},
-		"_ACLITEM": {DataTypeOID: 25, DataTypeSize: -1},
-		"NAME":     {DataTypeOID: 25, DataTypeSize: -1},
-		"TEXT":     {DataTypeOID: 25, DataTypeSize: -1},
-		"VARCHAR":  {DataTypeOID: 25, DataTypeSize: -1},
-		"OID":      {DataTypeOID: 26, DataTypeSize: 4},
-		"TID":      {DataTypeOID: 27, DataTypeSize: 6},
-		"XID":      {DataTypeOID: 28, DataTypeSize: 4},
-		"CID":      {DataTypeOID: 29, DataTypeSize: 4},
-		"JSON":     {DataTypeOID: 114, DataTypeSize: -1},
-		"XML":      {DataTypeOID: 142, DataTypeSize: -1},
-		"POINT":    {DataTypeOID: 600, DataTypeSize: 16},
-		"FLOAT4":   {DataTypeOID: 700, DataTypeSize: 4},
-		"FLOAT8":   {DataTypeOID: 701, DataTypeSize: 8},
-	}
-}
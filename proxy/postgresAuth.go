@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"dbrwproxy/postgres"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"log"
+)
+
+// login authenticates the client against the user list, then logs in to
+// the main server with the credentials the user maps to and relays the
+// rest of the startup to the client.
+func (p *PostgresProxy) login(startup *pgproto3.StartupMessage) error {
+	name := startup.Parameters["user"]
+	user, known := p.users.users[name]
+	var err error
+	if p.users.method == "md5" {
+		err = p.md5Auth(name, user.Password)
+	} else {
+		err = p.scramAuth(user.Password)
+	}
+	if err == nil && !known {
+		err = postgres.ErrPasswordMismatch
+	}
+	switch {
+	case err == postgres.ErrPasswordMismatch:
+		log.Println("Password authentication failed for user", name, "from", p.localConn.RemoteAddr())
+		p.send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "28P01",
+			Message:  fmt.Sprintf("password authentication failed for user %q", name),
+		})
+		return err
+	case err != nil:
+		// a malformed or unexpected message of the exchange
+		log.Println("Authentication failed for user", name, "from", p.localConn.RemoteAddr(), err)
+		p.send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "08P01",
+			Message:  err.Error(),
+		})
+		return err
+	}
+
+	main := mainCredentials(user)
+	params := make(map[string]string)
+	for k, v := range startup.Parameters {
+		params[k] = v
+	}
+	params["user"] = main.User
+	p.frontend.Send(&pgproto3.StartupMessage{ProtocolVersion: startup.ProtocolVersion, Parameters: params})
+	if err = p.frontend.Flush(); err != nil {
+		return err
+	}
+	if err = postgres.Authenticate(p.frontend, main.User, main.Password); err != nil {
+		if pgErr, ok := err.(*postgres.Error); ok {
+			p.send(&pgErr.Response)
+		}
+		return fmt.Errorf("main server rejected user %s: %v", main.User, err)
+	}
+	p.client.secondary = secondaryCredentials(user)
+	if err = p.send(&pgproto3.AuthenticationOk{}); err != nil {
+		return err
+	}
+	return p.authenticate()
+}
+
+// md5Auth has the client prove password with an md5 challenge.
+func (p *PostgresProxy) md5Auth(user, password string) error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+	if err := p.send(&pgproto3.AuthenticationMD5Password{Salt: salt}); err != nil {
+		return err
+	}
+	if err := p.backend.SetAuthType(pgproto3.AuthTypeMD5Password); err != nil {
+		return err
+	}
+	msg, err := p.backend.Receive()
+	if err != nil {
+		return err
+	}
+	reply, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	expected := postgres.MD5Password(user, password, salt)
+	if subtle.ConstantTimeCompare([]byte(reply.Password), []byte(expected)) != 1 {
+		return postgres.ErrPasswordMismatch
+	}
+	return nil
+}
+
+// scramAuth has the client prove password with a SCRAM-SHA-256 exchange.
+func (p *PostgresProxy) scramAuth(password string) error {
+	err := p.send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}})
+	if err != nil {
+		return err
+	}
+	if err = p.backend.SetAuthType(pgproto3.AuthTypeSASL); err != nil {
+		return err
+	}
+	msg, err := p.backend.Receive()
+	if err != nil {
+		return err
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	if initial.AuthMechanism != "SCRAM-SHA-256" {
+		return fmt.Errorf("unsupported SASL mechanism %s", initial.AuthMechanism)
+	}
+	server := postgres.NewSCRAMServer(password)
+	first, err := server.First(initial.Data)
+	if err != nil {
+		return err
+	}
+	if err = p.send(&pgproto3.AuthenticationSASLContinue{Data: first}); err != nil {
+		return err
+	}
+	if err = p.backend.SetAuthType(pgproto3.AuthTypeSASLContinue); err != nil {
+		return err
+	}
+	if msg, err = p.backend.Receive(); err != nil {
+		return err
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	final, err := server.Final(response.Data)
+	if err != nil {
+		return err
+	}
+	return p.send(&pgproto3.AuthenticationSASLFinal{Data: final})
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"dbrwproxy/config"
+	"dbrwproxy/postgres"
+	"errors"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"net"
+	"testing"
+)
+
+func TestPostgresLoginRejects(t *testing.T) {
+	users := map[string]config.User{"app": {Name: "app", Password: "secret"}}
+	// malformed sends a client-first-message asking for channel binding
+	malformed := func(frontend *pgproto3.Frontend) error {
+		if _, err := frontend.Receive(); err != nil {
+			return err
+		}
+		frontend.Send(&pgproto3.SASLInitialResponse{AuthMechanism: "SCRAM-SHA-256", Data: []byte("p=tls-server-end-point,,n=,r=abc")})
+		if err := frontend.Flush(); err != nil {
+			return err
+		}
+		for {
+			msg, err := frontend.Receive()
+			if err != nil {
+				return err
+			}
+			if msg, ok := msg.(*pgproto3.ErrorResponse); ok {
+				return postgres.ErrorFromResponse(msg)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		user     string
+		password string
+		client   func(*pgproto3.Frontend) error
+		code     string
+	}{
+		{name: "SCRAM wrong password", method: "scram-sha-256", user: "app", password: "guess", code: "28P01"},
+		{name: "SCRAM unknown user", method: "scram-sha-256", user: "nobody", password: "secret", code: "28P01"},
+		{name: "SCRAM unknown user without password", method: "scram-sha-256", user: "nobody", code: "28P01"},
+		{name: "SCRAM malformed", method: "scram-sha-256", user: "app", client: malformed, code: "08P01"},
+		{name: "md5 wrong password", method: "md5", user: "app", password: "guess", code: "28P01"},
+		{name: "md5 unknown user", method: "md5", user: "nobody", password: "secret", code: "28P01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, local := net.Pipe()
+			defer client.Close()
+			p := &PostgresProxy{
+				localConn: local,
+				backend:   pgproto3.NewBackend(local, local),
+				users:     &userList{method: tt.method, users: users},
+			}
+			done := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				done <- p.login(&pgproto3.StartupMessage{Parameters: map[string]string{"user": tt.user}})
+			}()
+
+			frontend := pgproto3.NewFrontend(client, client)
+			var err error
+			if tt.client != nil {
+				err = tt.client(frontend)
+			} else {
+				err = postgres.Authenticate(frontend, tt.user, tt.password)
+			}
+			var pgErr *postgres.Error
+			if !errors.As(err, &pgErr) || pgErr.Response.Code != tt.code {
+				t.Errorf("client got %v, want an error with SQLSTATE %s", err, tt.code)
+			}
+			if err = <-done; err == nil {
+				t.Error("login succeeded")
+			}
+		})
+	}
+}
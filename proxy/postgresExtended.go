@@ -0,0 +1,543 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"dbrwproxy/classifier"
+	"dbrwproxy/postgres"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"log"
+)
+
+// pgStatement is a statement prepared by the client with Parse. It is
+// prepared lazily on whichever server ends up executing it: on the main
+// server under the client's name, on secondaries as the unnamed statement
+// if the client's is unnamed and under replicaName otherwise, which is
+// derived from its definition so pooled connections can share it.
+type pgStatement struct {
+	query       string
+	hints       classifier.Hints
+	paramOIDs   []uint32
+	replicaName string
+}
+
+func newPgStatement(msg *pgproto3.Parse, hints classifier.Hints) *pgStatement {
+	h := sha1.New()
+	h.Write([]byte(msg.Query))
+	for _, oid := range msg.ParameterOIDs {
+		_ = binary.Write(h, binary.BigEndian, oid)
+	}
+	return &pgStatement{
+		query:       msg.Query,
+		hints:       hints,
+		paramOIDs:   append([]uint32(nil), msg.ParameterOIDs...),
+		replicaName: "dbrwproxy_" + hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+func (stmt *pgStatement) parse(name string) *pgproto3.Parse {
+	return &pgproto3.Parse{Name: name, Query: stmt.query, ParameterOIDs: stmt.paramOIDs}
+}
+
+// pgMessage is a message of the extended query protocol with the statement
+// it parses, binds or describes, as it was when the message arrived: a
+// later Parse of the same batch may replace the statement under its name.
+type pgMessage struct {
+	msg  pgproto3.FrontendMessage
+	stmt *pgStatement
+}
+
+// message returns msg with the statement it refers to.
+func (p *PostgresProxy) message(msg pgproto3.FrontendMessage) pgMessage {
+	var stmt *pgStatement
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		stmt = p.statements[msg.Name]
+	case *pgproto3.Bind:
+		stmt = p.statements[msg.PreparedStatement]
+	case *pgproto3.Describe:
+		if msg.ObjectType == 'S' {
+			stmt = p.statements[msg.Name]
+		}
+	}
+	return pgMessage{msg: msg, stmt: stmt}
+}
+
+// pgStep is one message of a batch sent to a secondary.
+type pgStep struct {
+	// msg is sent to the server, or nil if the proxy answers with reply.
+	msg   pgproto3.FrontendMessage
+	reply pgproto3.BackendMessage
+	// hidden steps were added by the proxy, their responses are dropped.
+	hidden bool
+	// prepared is the statement name recorded on the connection once the
+	// server confirmed the Parse.
+	prepared string
+}
+
+// delegateExtended handles a message of the extended query protocol.
+// Messages are held back until Sync, then the whole batch is sent either
+// to a secondary, if it only executes read-only statements outside a
+// transaction, or to the main server. A Flush commits the batch to the
+// main server, since the client then expects responses before Sync.
+func (p *PostgresProxy) delegateExtended(msg pgproto3.FrontendMessage) error {
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		hints, query := p.hints(msg.Query)
+		msg.Query = query
+		p.statements[msg.Name] = newPgStatement(msg, hints)
+	case *pgproto3.Close:
+		if msg.ObjectType == 'S' {
+			delete(p.statements, msg.Name)
+			if p.pinned != nil && p.mainStatements[msg.Name] != nil {
+				p.mainCloses = append(p.mainCloses, msg.Name)
+			}
+		}
+	}
+
+	if p.batchOnMain {
+		return p.sendMain(p.message(msg))
+	}
+	msg, err := copyFrontendMessage(msg)
+	if err != nil {
+		return err
+	}
+	p.pending = append(p.pending, p.message(msg))
+	switch msg.(type) {
+	case *pgproto3.Sync:
+		batch := p.pending
+		p.pending = nil
+		if p.pinned != nil {
+			for _, m := range batch {
+				if _, ok := m.msg.(*pgproto3.Bind); ok && m.stmt != nil {
+					if verdict := p.classifier.Classify(m.stmt.query); changesSession(verdict) {
+						return p.writeNotSupported(verdict.Reason, "in a read-only transaction on a secondary")
+					}
+				}
+			}
+			return p.endPinned(p.relayBatch(p.pinned, batch))
+		}
+		rt := p.routeBatch(batch)
+		if rt.reject != nil {
+			log.Println("Reject: rule", rt.reject.name)
+			return p.writeReject(rt.reject)
+		}
+		if !rt.main {
+			db := p.chooseCausal(rt.sel)
+			switch {
+			case db != nil && rt.pin:
+				return p.runPinned(db, batch)
+			case db != nil:
+				return p.runOnSecondary(db, batch)
+			}
+		}
+		return p.sendMain(batch...)
+	case *pgproto3.Flush:
+		return p.flushPending()
+	}
+	return nil
+}
+
+// flushPending sends held back messages to the main server, which then
+// receives the rest of the batch as well. In a read-only transaction on a
+// secondary, they are held until Sync instead.
+func (p *PostgresProxy) flushPending() error {
+	if len(p.pending) == 0 || p.pinned != nil {
+		return nil
+	}
+	batch := p.pending
+	p.pending = nil
+	p.batchOnMain = true
+	return p.sendMain(batch...)
+}
+
+// sendMain forwards messages to the main server, preparing statements the
+// client prepared while its batches ran on secondaries first.
+func (p *PostgresProxy) sendMain(msgs ...pgMessage) error {
+	for _, name := range p.mainCloses {
+		p.frontend.Send(&pgproto3.Close{ObjectType: 'S', Name: name})
+		delete(p.mainStatements, name)
+		p.mainMu.Lock()
+		p.hiddenCloses[len(p.hiddenCloses)-1]++
+		p.mainMu.Unlock()
+	}
+	p.mainCloses = nil
+	flush := false
+	for _, m := range msgs {
+		switch msg := m.msg.(type) {
+		case *pgproto3.Parse:
+			p.mainStatements[msg.Name] = m.stmt
+		case *pgproto3.Bind:
+			p.prepareOnMain(msg.PreparedStatement, m.stmt)
+			p.portals[msg.DestinationPortal] = m.stmt
+		case *pgproto3.Describe:
+			if msg.ObjectType == 'S' {
+				p.prepareOnMain(msg.Name, m.stmt)
+			}
+		case *pgproto3.Execute:
+			if stmt := p.portals[msg.Portal]; stmt != nil {
+				log.Println("Choose main")
+				log.Println("Execute SQL -> [" + stmt.query + "]")
+				verdict := p.classifier.Classify(stmt.query)
+				p.consistency.wrote(verdict)
+				p.state.update(verdict.State)
+				p.settings.update(verdict.Settings)
+			}
+		case *pgproto3.Close:
+			if msg.ObjectType == 'S' {
+				delete(p.mainStatements, msg.Name)
+			} else {
+				delete(p.portals, msg.Name)
+			}
+		case *pgproto3.Query:
+			// a simple query replaces the unnamed statement
+			delete(p.mainStatements, "")
+			p.syncMain()
+			flush = true
+		case *pgproto3.Sync, *pgproto3.FunctionCall:
+			p.batchOnMain = false
+			p.syncMain()
+			flush = true
+		default:
+			flush = true
+		}
+		p.frontend.Send(m.msg)
+	}
+	if !flush {
+		return nil
+	}
+	return p.frontend.Flush()
+}
+
+// prepareOnMain sends a hidden Parse if the main server does not hold stmt,
+// which the client knows under name.
+func (p *PostgresProxy) prepareOnMain(name string, stmt *pgStatement) {
+	if stmt == nil || p.mainStatements[name] == stmt {
+		return
+	}
+	p.frontend.Send(stmt.parse(name))
+	p.mainStatements[name] = stmt
+	p.mainMu.Lock()
+	p.hiddenParses[len(p.hiddenParses)-1]++
+	p.mainMu.Unlock()
+}
+
+// syncMain starts counting hidden Parses for the next cycle on the main
+// server, which ends with a ReadyForQuery.
+func (p *PostgresProxy) syncMain() {
+	p.mainMu.Lock()
+	p.hiddenParses = append(p.hiddenParses, 0)
+	p.hiddenCloses = append(p.hiddenCloses, 0)
+	p.mainMu.Unlock()
+}
+
+// dropOutbound reports whether a message from the main server answers a
+// hidden Parse and must not reach the client.
+func (p *PostgresProxy) dropOutbound(msg pgproto3.BackendMessage) bool {
+	p.mainMu.Lock()
+	defer p.mainMu.Unlock()
+	if p.lsn != nil {
+		// answers the hidden query of mainLSN
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			if len(msg.Values) == 1 {
+				p.lsnValue = string(msg.Values[0])
+			}
+		case *pgproto3.ReadyForQuery:
+			p.lsn <- p.lsnValue
+			p.lsn, p.lsnValue = nil, ""
+		}
+		return true
+	}
+	switch msg.(type) {
+	case *pgproto3.ParseComplete:
+		if p.hiddenParses[0] > 0 {
+			p.hiddenParses[0]--
+			return true
+		}
+	case *pgproto3.CloseComplete:
+		if p.hiddenCloses[0] > 0 {
+			p.hiddenCloses[0]--
+			return true
+		}
+	case *pgproto3.ReadyForQuery:
+		if len(p.hiddenParses) > 1 {
+			p.hiddenParses = p.hiddenParses[1:]
+			p.hiddenCloses = p.hiddenCloses[1:]
+		}
+	}
+	return false
+}
+
+// routeBatch decides where a batch ending with Sync goes. It can run on a
+// secondary only if it executes something, and only statements bound
+// within the batch itself, since portals do not outlive the implicit
+// transaction ended by Sync. Each statement is routed on its own: any
+// rejected statement rejects the batch, any statement for the main server
+// sends it there, and a later selector overrides an earlier one.
+func (p *PostgresProxy) routeBatch(batch []pgMessage) routing {
+	inTrans := p.inTransaction()
+	sticky := p.consistency.sticky(inTrans, p.mainLSN)
+	held := p.state.reason()
+	route := func(stmt *pgStatement) routing {
+		return routeStatement(p.classifier, p.rules, &p.client, stmt.query, stmt.hints, inTrans, held, sticky)
+	}
+	var rt routing
+	portals := make(map[string]bool)
+	executes := false
+	for _, m := range batch {
+		switch msg := m.msg.(type) {
+		case *pgproto3.Parse:
+			stmt := route(m.stmt)
+			if stmt.reject != nil {
+				return stmt
+			}
+			if stmt.main && !rt.main {
+				rt.main, rt.reason = true, stmt.reason
+			}
+		case *pgproto3.Bind:
+			if m.stmt == nil {
+				return routing{main: true, reason: "unknown statement"}
+			}
+			bound := route(m.stmt)
+			if bound.reject != nil {
+				return bound
+			}
+			if bound.main && !rt.main {
+				rt.main, rt.reason = true, bound.reason
+			}
+			if bound.sel != (selector{}) {
+				rt.sel = bound.sel
+			}
+			rt.pin = rt.pin || bound.pin
+			portals[msg.DestinationPortal] = true
+		case *pgproto3.Describe:
+			if msg.ObjectType == 'S' && m.stmt == nil ||
+				msg.ObjectType == 'P' && !portals[msg.Name] {
+				return routing{main: true, reason: "describes an object of the main server"}
+			}
+		case *pgproto3.Execute:
+			if !portals[msg.Portal] {
+				return routing{main: true, reason: "executes a portal of the main server"}
+			}
+			executes = true
+		case *pgproto3.Sync:
+		default:
+			return routing{main: true, reason: "unsupported message in batch"}
+		}
+	}
+	if !executes && !rt.main {
+		rt.main, rt.reason = true, "executes nothing"
+	}
+	return rt
+}
+
+// runOnSecondary executes a read-only batch on a pooled connection to db
+// and relays the responses.
+func (p *PostgresProxy) runOnSecondary(db *WeightedDB, batch []pgMessage) error {
+	connPool := db.poolFor(&p.client)
+	conn, err := connPool.Get()
+	if err != nil {
+		log.Println("Secondary connection failed:", err)
+		return p.writeError(err)
+	}
+	if err = p.configure(conn); err != nil {
+		log.Println("Choose main instead: session settings failed on", db.Name, err)
+		connPool.Put(conn)
+		return p.sendMain(batch...)
+	}
+	err = p.relayBatch(conn, batch)
+	if conn.TxStatus() != 'I' {
+		conn.Close()
+	}
+	connPool.Put(conn)
+	if err != nil {
+		log.Println("Secondary query failed:", err)
+		return p.writeError(err)
+	}
+	return nil
+}
+
+// runPinned starts a read-only transaction with a batch on a connection to
+// db, which runs the rest of the transaction as well.
+func (p *PostgresProxy) runPinned(db *WeightedDB, batch []pgMessage) error {
+	connPool := db.poolFor(&p.client)
+	conn, err := connPool.Get()
+	if err != nil {
+		log.Println("Secondary connection failed:", err)
+		return p.writeError(err)
+	}
+	if err = p.configure(conn); err != nil {
+		log.Println("Choose main instead: session settings failed on", db.Name, err)
+		connPool.Put(conn)
+		return p.sendMain(batch...)
+	}
+	p.pin(db, conn)
+	return p.endPinned(p.relayBatch(conn, batch))
+}
+
+// relayBatch executes batch on conn and relays the responses. Statements
+// the client named are prepared under their replicaName and stay prepared
+// on the connection, the unnamed statement is prepared as the unnamed
+// statement of the connection whenever a message of the batch refers to it.
+func (p *PostgresProxy) relayBatch(conn *postgres.PostgresConn, batch []pgMessage) error {
+	var steps []pgStep
+	for _, name := range conn.Evicted() {
+		steps = append(steps, pgStep{msg: &pgproto3.Close{ObjectType: 'S', Name: name}, hidden: true})
+	}
+	prepared := make(map[string]bool)
+	// unnamed is the statement prepared as the unnamed one by the batch
+	var unnamed *pgStatement
+	// ensure prepares stmt, known to the client under name, unless it
+	// already is, and returns its name on the server
+	ensure := func(name string, stmt *pgStatement) string {
+		if name == "" {
+			if unnamed != stmt {
+				unnamed = stmt
+				steps = append(steps, pgStep{msg: stmt.parse(""), hidden: true})
+			}
+			return ""
+		}
+		if !conn.Prepared(stmt.replicaName) && !prepared[stmt.replicaName] {
+			prepared[stmt.replicaName] = true
+			steps = append(steps, pgStep{msg: stmt.parse(stmt.replicaName), hidden: true, prepared: stmt.replicaName})
+		}
+		return stmt.replicaName
+	}
+	portals := make(map[string]*pgStatement)
+	for _, m := range batch {
+		switch msg := m.msg.(type) {
+		case *pgproto3.Parse:
+			stmt := m.stmt
+			if msg.Name == "" {
+				unnamed = stmt
+				steps = append(steps, pgStep{msg: stmt.parse("")})
+				continue
+			}
+			if conn.Prepared(stmt.replicaName) || prepared[stmt.replicaName] {
+				steps = append(steps, pgStep{reply: &pgproto3.ParseComplete{}})
+				continue
+			}
+			prepared[stmt.replicaName] = true
+			steps = append(steps, pgStep{msg: stmt.parse(stmt.replicaName), prepared: stmt.replicaName})
+		case *pgproto3.Bind:
+			// in a read-only transaction, the statement may be unknown
+			// and the server report it
+			if stmt := m.stmt; stmt != nil {
+				msg.PreparedStatement = ensure(msg.PreparedStatement, stmt)
+				portals[msg.DestinationPortal] = stmt
+			}
+			steps = append(steps, pgStep{msg: msg})
+		case *pgproto3.Describe:
+			if stmt := m.stmt; stmt != nil {
+				msg.Name = ensure(msg.Name, stmt)
+			}
+			steps = append(steps, pgStep{msg: msg})
+		case *pgproto3.Execute:
+			// or the portal bound by an earlier batch
+			if stmt := portals[msg.Portal]; stmt != nil {
+				log.Println("Execute SQL -> [" + stmt.query + "]")
+			}
+			steps = append(steps, pgStep{msg: msg})
+		default:
+			steps = append(steps, pgStep{msg: msg})
+		}
+	}
+
+	var sent []pgproto3.FrontendMessage
+	for _, step := range steps {
+		if step.msg != nil {
+			sent = append(sent, step.msg)
+		}
+	}
+	if err := conn.Send(sent...); err != nil {
+		return err
+	}
+
+	var out []byte
+	failed := false
+	for _, step := range steps {
+		if step.msg == nil {
+			if !failed {
+				out = step.reply.Encode(out)
+			}
+			continue
+		}
+		if _, ok := step.msg.(*pgproto3.Sync); failed && !ok {
+			// the server skips everything up to Sync after an error
+			continue
+		}
+		for {
+			msg, err := conn.Receive()
+			if err != nil {
+				return err
+			}
+			switch msg := msg.(type) {
+			case *pgproto3.ParameterStatus:
+				// settings of the secondary session are not the client's
+				continue
+			case *pgproto3.ErrorResponse:
+				secondaryError(msg)
+				failed = true
+			case *pgproto3.ParseComplete:
+				if step.prepared != "" {
+					conn.NotePrepared(step.prepared)
+				}
+			}
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				out = p.readyForQuery().Encode(out)
+			} else if !step.hidden || failed {
+				out = msg.Encode(out)
+			}
+			if len(out) > 65536 {
+				if err = p.write(out); err != nil {
+					return err
+				}
+				out = out[:0]
+			}
+			if completesStep(msg) {
+				break
+			}
+		}
+	}
+	return p.write(out)
+}
+
+// completesStep reports whether msg is the last response to a message of
+// the extended query protocol.
+func completesStep(msg pgproto3.BackendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.DataRow, *pgproto3.ParameterDescription, *pgproto3.NoticeResponse,
+		*pgproto3.ParameterStatus, *pgproto3.NotificationResponse:
+		return false
+	}
+	return true
+}
+
+// copyFrontendMessage returns a copy of msg that remains valid after the
+// next Receive.
+func copyFrontendMessage(msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+	var dst pgproto3.FrontendMessage
+	switch msg.(type) {
+	case *pgproto3.Parse:
+		dst = &pgproto3.Parse{}
+	case *pgproto3.Bind:
+		dst = &pgproto3.Bind{}
+	case *pgproto3.Describe:
+		dst = &pgproto3.Describe{}
+	case *pgproto3.Execute:
+		dst = &pgproto3.Execute{}
+	case *pgproto3.Close:
+		dst = &pgproto3.Close{}
+	case *pgproto3.Sync:
+		dst = &pgproto3.Sync{}
+	case *pgproto3.Flush:
+		dst = &pgproto3.Flush{}
+	default:
+		return nil, fmt.Errorf("unexpected message %T", msg)
+	}
+	buf := msg.Encode(nil)
+	return dst, dst.Decode(buf[5:])
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"dbrwproxy/classifier"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"testing"
+)
+
+func newTestPostgresProxy(main *bytes.Buffer) *PostgresProxy {
+	return &PostgresProxy{
+		classifier:     classifier.New(classifier.PostgreSQL, nil),
+		frontend:       pgproto3.NewFrontend(bytes.NewReader(nil), main),
+		txStatus:       'I',
+		statements:     make(map[string]*pgStatement),
+		mainStatements: make(map[string]*pgStatement),
+		portals:        make(map[string]*pgStatement),
+		hiddenParses:   []int{0},
+		hiddenCloses:   []int{0},
+		replayedLSN:    make(map[string]uint64),
+	}
+}
+
+// unnamedBatch is a JDBC style batch reusing the unnamed statement.
+func unnamedBatch() []pgproto3.FrontendMessage {
+	return []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "INSERT INTO t VALUES (1)"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Parse{Query: "SELECT * FROM t"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	}
+}
+
+func TestRouteBatchReusingUnnamedStatement(t *testing.T) {
+	var main bytes.Buffer
+	p := newTestPostgresProxy(&main)
+	var batch []pgMessage
+	for _, msg := range unnamedBatch() {
+		if parse, ok := msg.(*pgproto3.Parse); ok {
+			p.statements[parse.Name] = newPgStatement(parse, classifier.Hints{})
+		}
+		batch = append(batch, p.message(msg))
+	}
+	rt := p.routeBatch(batch)
+	if !rt.main {
+		t.Fatalf("batch writing routed to a secondary: %+v", rt)
+	}
+}
+
+func TestSendBatchReusingUnnamedStatement(t *testing.T) {
+	var main bytes.Buffer
+	p := newTestPostgresProxy(&main)
+	for _, msg := range unnamedBatch() {
+		if err := p.delegateExtended(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !p.consistency.pending {
+		t.Error("the write of the batch was not noted")
+	}
+
+	backend := pgproto3.NewBackend(&main, nil)
+	var queries []string
+	var types []string
+	for len(types) == 0 || types[len(types)-1] != "Sync" {
+		msg, err := backend.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Parse:
+			queries = append(queries, msg.Query)
+			types = append(types, "Parse")
+		case *pgproto3.Bind:
+			types = append(types, "Bind")
+		case *pgproto3.Execute:
+			types = append(types, "Execute")
+		case *pgproto3.Sync:
+			types = append(types, "Sync")
+		default:
+			t.Fatalf("unexpected message %T", msg)
+		}
+	}
+	want := []string{"Parse", "Bind", "Execute", "Parse", "Bind", "Execute", "Sync"}
+	if len(types) != len(want) {
+		t.Fatalf("main server received %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("main server received %v, want %v", types, want)
+		}
+	}
+	if len(queries) != 2 || queries[0] != "INSERT INTO t VALUES (1)" || queries[1] != "SELECT * FROM t" {
+		t.Errorf("main server parsed %q", queries)
+	}
+}
+
+func TestChangesSession(t *testing.T) {
+	cls := classifier.New(classifier.PostgreSQL, nil)
+	tests := []struct {
+		query   string
+		changes bool
+	}{
+		{"SELECT * FROM t", false},
+		{"SHOW search_path", false},
+		{"SET LOCAL statement_timeout = 5000", false},
+		{"DECLARE c CURSOR FOR SELECT * FROM t", false},
+		{"FETCH 10 FROM c", false},
+		{"SET search_path = s", true},
+		{"SET SESSION statement_timeout = 5000", true},
+		{"RESET ALL", true},
+		{"PREPARE q AS SELECT 1", true},
+		{"LISTEN events", true},
+	}
+	for _, tt := range tests {
+		if got := changesSession(cls.Classify(tt.query)); got != tt.changes {
+			t.Errorf("changesSession(%q) = %v, want %v", tt.query, got, tt.changes)
+		}
+	}
+}
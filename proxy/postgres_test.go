@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"github.com/jackc/pgx/v5/pgproto3"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestStartupDeclinesEncryption(t *testing.T) {
+	client, local := net.Pipe()
+	p := &PostgresProxy{
+		localConn: local,
+		backend:   pgproto3.NewBackend(local, local),
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		done <- p.startup()
+	}()
+
+	for _, request := range []pgproto3.FrontendMessage{&pgproto3.GSSEncRequest{}, &pgproto3.SSLRequest{}} {
+		if _, err := client.Write(request.Encode(nil)); err != nil {
+			t.Fatal(err)
+		}
+		var answer [1]byte
+		if _, err := io.ReadFull(client, answer[:]); err != nil {
+			t.Fatal(err)
+		}
+		if answer[0] != 'N' {
+			t.Errorf("%T answered with %q without a certificate, want N", request, answer[0])
+		}
+	}
+	client.Close()
+	if err := <-done; err == nil {
+		t.Error("startup succeeded without a startup message")
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"database/sql/driver"
+	"dbrwproxy/pool"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lagProbeInterval is how long a measured replication lag is reused.
+const lagProbeInterval = time.Second
+
+// postgresLagQuery returns the replication lag of a standby in seconds. A
+// standby that replayed everything it received is not lagging, however
+// old its last replayed transaction is.
+const postgresLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+// postgresLSNQuery returns the current WAL position of the main server.
+const postgresLSNQuery = "SELECT pg_current_wal_lsn()"
+
+// replayPollInterval is how often a PostgreSQL secondary is asked whether
+// it replayed a WAL position while waiting for it.
+const replayPollInterval = 10 * time.Millisecond
+
+// lagProbe measures the replication lag of a secondary when asked for it.
+// One measurement runs at a time, without holding mu.
+type lagProbe struct {
+	mu       sync.Mutex
+	measure  func() (time.Duration, error)
+	measured time.Time
+	lag      time.Duration
+	err      error
+	// measuring is closed when the measurement in progress completes, and
+	// nil when none is.
+	measuring chan struct{}
+}
+
+// Lag returns the replication lag of the secondary, measured at most
+// lagProbeInterval ago, or the last one while it is measured again.
+func (lp *lagProbe) Lag() (time.Duration, error) {
+	lp.mu.Lock()
+	if time.Since(lp.measured) <= lagProbeInterval || lp.measuring != nil && !lp.measured.IsZero() {
+		defer lp.mu.Unlock()
+		return lp.lag, lp.err
+	}
+	if done := lp.measuring; done != nil {
+		// the first measurement
+		lp.mu.Unlock()
+		<-done
+		lp.mu.Lock()
+		defer lp.mu.Unlock()
+		return lp.lag, lp.err
+	}
+	done := make(chan struct{})
+	lp.measuring = done
+	lp.mu.Unlock()
+
+	lag, err := lp.measure()
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.lag, lp.err, lp.measured = lag, err, time.Now()
+	lp.measuring = nil
+	close(done)
+	return lag, err
+}
+
+func newPostgresLagProbe(connPool *pool.PostgresConnectionPool) *lagProbe {
+	return &lagProbe{measure: func() (time.Duration, error) {
+		conn, err := connPool.Get()
+		if err != nil {
+			return 0, err
+		}
+		defer connPool.Put(conn)
+		row, err := conn.QueryRow(postgresLagQuery)
+		if err != nil {
+			return 0, err
+		}
+		if len(row) == 0 || row[0] == nil {
+			return 0, errors.New("replication lag not reported")
+		}
+		seconds, err := strconv.ParseFloat(string(row[0]), 64)
+		return time.Duration(seconds * float64(time.Second)), err
+	}}
+}
+
+func newMysqlLagProbe(connPool *pool.ConnectionPool) *lagProbe {
+	return &lagProbe{measure: func() (time.Duration, error) {
+		conn, err := connPool.Get()
+		if err != nil {
+			return 0, err
+		}
+		defer connPool.Put(conn)
+		rows, err := conn.Query("SHOW REPLICA STATUS", nil)
+		if err != nil {
+			// before MySQL 8.0.22
+			rows, err = conn.Query("SHOW SLAVE STATUS", nil)
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		columns := rows.Columns()
+		values := make([]driver.Value, len(columns))
+		err = rows.Next(values)
+		if err == io.EOF {
+			// not a replica
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		for i, column := range columns {
+			if column != "Seconds_Behind_Source" && column != "Seconds_Behind_Master" {
+				continue
+			}
+			value, ok := values[i].([]byte)
+			if !ok {
+				return 0, errors.New("replication is not running")
+			}
+			seconds, err := strconv.ParseInt(string(value), 10, 64)
+			return time.Duration(seconds) * time.Second, err
+		}
+		return 0, errors.New("replication lag not reported")
+	}}
+}
+
+// mysqlExecuted reports whether a MySQL secondary executed the GTID set
+// gtids, waiting up to wait for it to.
+func mysqlExecuted(connPool *pool.ConnectionPool, gtids string, wait time.Duration) (bool, error) {
+	if strings.ContainsAny(gtids, `'\`) {
+		return false, errors.New("invalid GTID set " + gtids)
+	}
+	query, executed := "SELECT GTID_SUBSET('"+gtids+"', @@GLOBAL.gtid_executed)", "1"
+	if wait > 0 {
+		// returns 1 on timeout
+		query, executed = fmt.Sprintf("SELECT WAIT_FOR_EXECUTED_GTID_SET('%s', %g)", gtids, wait.Seconds()), "0"
+	}
+	conn, err := connPool.Get()
+	if err != nil {
+		return false, err
+	}
+	defer connPool.Put(conn)
+	rows, err := conn.Query(query, nil)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	err = rows.Next(values)
+	if err != nil {
+		return false, err
+	}
+	value, _ := values[0].([]byte)
+	return string(value) == executed, nil
+}
+
+// parseLSN parses a PostgreSQL WAL position such as 16/B374D848.
+func parseLSN(lsn string) (uint64, error) {
+	hi, lo, ok := strings.Cut(lsn, "/")
+	if !ok {
+		return 0, errors.New("invalid WAL position " + lsn)
+	}
+	high, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	low, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return high<<32 | low, nil
+}
+
+// postgresReplayed reports whether a PostgreSQL secondary replayed the WAL
+// up to lsn, waiting up to wait for it to.
+func postgresReplayed(connPool *pool.PostgresConnectionPool, lsn string, wait time.Duration) (bool, error) {
+	if _, err := parseLSN(lsn); err != nil {
+		return false, err
+	}
+	conn, err := connPool.Get()
+	if err != nil {
+		return false, err
+	}
+	defer connPool.Put(conn)
+	query := "SELECT COALESCE(pg_last_wal_replay_lsn() >= '" + lsn + "'::pg_lsn, false)"
+	deadline := time.Now().Add(wait)
+	for {
+		row, err := conn.QueryRow(query)
+		if err != nil {
+			return false, err
+		}
+		if len(row) == 1 && string(row[0]) == "t" {
+			return true, nil
+		}
+		if !time.Now().Before(deadline) {
+			return false, nil
+		}
+		time.Sleep(replayPollInterval)
+	}
+}
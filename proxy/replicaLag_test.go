@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLagProbeMeasuresOnce(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	lp := &lagProbe{measure: func() (time.Duration, error) {
+		calls.Add(1)
+		<-release
+		return 3 * time.Second, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if lag, err := lp.Lag(); lag != 3*time.Second || err != nil {
+				t.Errorf("Lag() = %v, %v", lag, err)
+			}
+		}()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("measured %d times, want 1", n)
+	}
+}
+
+func TestLagProbeAnswersWhileMeasuring(t *testing.T) {
+	release := make(chan struct{})
+	lp := &lagProbe{
+		measure: func() (time.Duration, error) {
+			<-release
+			return 0, nil
+		},
+		measured: time.Now().Add(-2 * lagProbeInterval),
+		lag:      time.Second,
+	}
+	go lp.Lag()
+	for {
+		lp.mu.Lock()
+		measuring := lp.measuring != nil
+		lp.mu.Unlock()
+		if measuring {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if lag, _ := lp.Lag(); lag != time.Second {
+		t.Errorf("Lag() = %v while measuring, want the last lag", lag)
+	}
+	close(release)
+}
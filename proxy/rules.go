@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"dbrwproxy/config"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Routes a rule can take.
+const (
+	ruleMain      = "main"
+	ruleSecondary = "secondary"
+	ruleGroup     = "group"
+	ruleReject    = "reject"
+)
+
+// rule is a config.Rule ready to be matched.
+type rule struct {
+	name      string
+	pattern   *regexp.Regexp
+	tables    map[string]bool
+	users     map[string]bool
+	databases map[string]bool
+	clients   []*net.IPNet
+	route     string
+	target    string
+}
+
+// clientInfo describes the session rules are matched against.
+type clientInfo struct {
+	user     string
+	database string
+	addr     net.IP
+	// secondary holds the credentials the reads of the session run with,
+	// nil for those of the secondary configuration.
+	secondary *config.Credentials
+}
+
+// selector narrows the secondaries a statement may be sent to.
+type selector struct {
+	name   string
+	group  string
+	maxLag time.Duration
+	// position is the point in the history of the main server the
+	// secondary must have replayed: a GTID set for MySQL, a WAL position
+	// for PostgreSQL.
+	position string
+}
+
+// routing is where a statement goes: to the main server, to a secondary
+// chosen with sel, or nowhere if a rule rejects it.
+type routing struct {
+	main    bool
+	reason  string
+	reject  *rule
+	sel     selector
+	verdict classifier.Verdict
+	// pin is set for a statement starting a read-only transaction, whose
+	// statements all run on the secondary connection it runs on.
+	pin bool
+}
+
+// compileRules checks the rules of a proxy against its secondaries.
+func compileRules(conf []config.Rule, secondaries map[string]string) ([]*rule, error) {
+	groups := make(map[string]bool)
+	for _, group := range secondaries {
+		groups[group] = true
+	}
+	var rules []*rule
+	for i, c := range conf {
+		r := &rule{
+			name:      c.Name,
+			tables:    lowerSet(c.Tables),
+			users:     set(c.Users),
+			databases: set(c.Databases),
+			route:     c.Route,
+			target:    c.Target,
+		}
+		if r.name == "" {
+			r.name = fmt.Sprint("#", i+1)
+		}
+		if c.Pattern != "" {
+			pattern, err := regexp.Compile(c.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", r.name, err)
+			}
+			r.pattern = pattern
+		}
+		for _, client := range c.Clients {
+			if !strings.Contains(client, "/") {
+				if strings.Contains(client, ":") {
+					client += "/128"
+				} else {
+					client += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", r.name, err)
+			}
+			r.clients = append(r.clients, network)
+		}
+		switch r.route {
+		case ruleMain, ruleReject:
+		case ruleSecondary:
+			if _, ok := secondaries[r.target]; !ok {
+				return nil, fmt.Errorf("rule %s: no active secondary %q", r.name, r.target)
+			}
+		case ruleGroup:
+			if r.target == "" || !groups[r.target] {
+				return nil, fmt.Errorf("rule %s: no active secondary in group %q", r.name, r.target)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: invalid route %q", r.name, r.route)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+func lowerSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, v := range values {
+		m[strings.ToLower(v)] = true
+	}
+	return m
+}
+
+func (r *rule) matches(cls *classifier.Classifier, client *clientInfo, query string) bool {
+	if r.users != nil && !r.users[client.user] ||
+		r.databases != nil && !r.databases[client.database] ||
+		r.pattern != nil && !r.pattern.MatchString(query) {
+		return false
+	}
+	if r.clients != nil {
+		found := false
+		for _, network := range r.clients {
+			if client.addr != nil && network.Contains(client.addr) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.tables != nil {
+		for _, table := range cls.Tables(query) {
+			if r.tables[table] {
+				return true
+			}
+			// a rule naming a table without schema matches it in any
+			if dot := strings.LastIndexByte(table, '.'); dot >= 0 && r.tables[table[dot+1:]] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// routeStatement decides where a statement goes. Rejecting rules apply
+// first, then statements in a transaction or of a session holding state
+// named by held stay on the main server, then routing hints apply, then
+// reads of a session that must see its writes stay on the main server,
+// then the other rules and the verdict of the classifier apply, under
+// which a read-only transaction reads.
+func routeStatement(cls *classifier.Classifier, rules []*rule, client *clientInfo, query string,
+	hints classifier.Hints, inTrans bool, held string, sticky bool) routing {
+	verdict := cls.Classify(query)
+	var matched *rule
+	for _, r := range rules {
+		if r.matches(cls, client, query) {
+			matched = r
+			break
+		}
+	}
+	sel := selector{name: hints.Name, maxLag: hints.MaxLag}
+	pin := verdict.ReadOnly && verdict.Statements == 1
+	// hints and rules only send reads to secondaries
+	read := verdict.Kind == classifier.Read || pin
+	switch {
+	case matched != nil && matched.route == ruleReject:
+		return routing{reject: matched, verdict: verdict}
+	case inTrans:
+		return routing{main: true, reason: "in transaction", verdict: verdict}
+	case held != "":
+		return routing{main: true, reason: held, verdict: verdict}
+	case hints.Route == classifier.RouteMain:
+		return routing{main: true, reason: "routing hint", verdict: verdict}
+	case hints.Route == classifier.RouteReplica && read:
+		return routing{sel: sel, verdict: verdict, pin: pin}
+	case sticky:
+		return routing{main: true, reason: "read your writes", verdict: verdict}
+	case matched != nil && matched.route == ruleMain:
+		return routing{main: true, reason: "rule " + matched.name, verdict: verdict}
+	case matched != nil && matched.route == ruleSecondary && read:
+		sel.name = matched.target
+		return routing{sel: sel, verdict: verdict, pin: pin}
+	case matched != nil && matched.route == ruleGroup && read:
+		sel.name, sel.group = "", matched.target
+		return routing{sel: sel, verdict: verdict, pin: pin}
+	case !read:
+		return routing{main: true, reason: verdict.String(), verdict: verdict}
+	}
+	return routing{sel: sel, verdict: verdict, pin: pin}
+}
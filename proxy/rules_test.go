@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"dbrwproxy/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouteStatement(t *testing.T) {
+	rules, err := compileRules([]config.Rule{
+		{Name: "blocked", Pattern: "(?i)^drop ", Route: ruleReject},
+		{Name: "billing", Tables: []string{"invoices"}, Route: ruleMain},
+		{Name: "reports", Users: []string{"report"}, Route: ruleGroup, Target: "analytics"},
+		{Name: "office", Clients: []string{"10.0.0.0/8"}, Route: ruleSecondary, Target: "B"},
+	}, map[string]string{"A": "", "B": "analytics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &clientInfo{user: "app", addr: net.ParseIP("192.168.1.2")}
+	report := &clientInfo{user: "report", addr: net.ParseIP("192.168.1.2")}
+	office := &clientInfo{user: "app", addr: net.ParseIP("10.1.2.3")}
+	replica := classifier.Hints{Route: classifier.RouteReplica, Name: "A", MaxLag: time.Second}
+
+	tests := []struct {
+		name    string
+		client  *clientInfo
+		query   string
+		hints   classifier.Hints
+		inTrans bool
+		held    string
+		sticky  bool
+		// the routing expected, reject naming the rejecting rule
+		main   bool
+		reason string
+		reject string
+		sel    selector
+		pin    bool
+	}{
+		{name: "read", client: app, query: "SELECT * FROM t"},
+		{name: "write", client: app, query: "UPDATE t SET v = 1", main: true, reason: "write (UPDATE)"},
+		{name: "rejected", client: app, query: "DROP TABLE t", reject: "blocked"},
+		{name: "rejected in transaction", client: app, query: "DROP TABLE t", inTrans: true, reject: "blocked"},
+		{name: "in transaction", client: app, query: "SELECT * FROM t", inTrans: true, main: true, reason: "in transaction"},
+		{name: "held state", client: app, query: "SELECT * FROM t", held: "temporary table tmp", main: true, reason: "temporary table tmp"},
+		{name: "main hint", client: app, query: "SELECT * FROM t", hints: classifier.Hints{Route: classifier.RouteMain}, main: true, reason: "routing hint"},
+		{name: "replica hint", client: app, query: "SELECT * FROM t", hints: replica, sticky: true,
+			sel: selector{name: "A", maxLag: time.Second}},
+		{name: "replica hint on write", client: app, query: "DELETE FROM t", hints: replica, main: true, reason: "write (DELETE)"},
+		{name: "read your writes", client: app, query: "SELECT * FROM t", sticky: true, main: true, reason: "read your writes"},
+		{name: "main rule", client: app, query: "SELECT * FROM invoices", main: true, reason: "rule billing"},
+		{name: "group rule", client: report, query: "SELECT * FROM t", sel: selector{group: "analytics"}},
+		{name: "group rule on write", client: report, query: "INSERT INTO t VALUES (1)", main: true, reason: "write (INSERT)"},
+		{name: "secondary rule", client: office, query: "SELECT * FROM t", sel: selector{name: "B"}},
+		{name: "secondary rule on session state", client: office, query: "SET @x = 1", main: true, reason: "session state (SET user variable)"},
+		{name: "read-only transaction", client: report, query: "START TRANSACTION READ ONLY", sel: selector{group: "analytics"}, pin: true},
+		{name: "transaction", client: app, query: "BEGIN", main: true, reason: "transaction control (BEGIN)"},
+	}
+	cls := classifier.New(classifier.MySQL, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := routeStatement(cls, rules, tt.client, tt.query, tt.hints, tt.inTrans, tt.held, tt.sticky)
+			reject := ""
+			if rt.reject != nil {
+				reject = rt.reject.name
+			}
+			if reject != tt.reject {
+				t.Fatalf("rejected by %q, want %q", reject, tt.reject)
+			}
+			if rt.main != tt.main || rt.reason != tt.reason {
+				t.Errorf("main %v (%s), want %v (%s)", rt.main, rt.reason, tt.main, tt.reason)
+			}
+			if rt.sel != tt.sel || rt.pin != tt.pin {
+				t.Errorf("selector %+v, pin %v, want %+v, pin %v", rt.sel, rt.pin, tt.sel, tt.pin)
+			}
+		})
+	}
+}
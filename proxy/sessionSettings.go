@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+)
+
+// sessionSettings tracks the session variables a client set on the main
+// server, to set them alike on the secondary connections its reads run on.
+type sessionSettings struct {
+	// names in the order the client last set them, as some settings
+	// override others, like SET NAMES and SET CHARACTER SET.
+	names  []string
+	values map[string]string
+}
+
+// update records the settings of a statement run on the main server.
+func (s *sessionSettings) update(settings []classifier.Setting) {
+	for _, setting := range settings {
+		if setting.Name == "" {
+			s.names, s.values = nil, nil
+			continue
+		}
+		s.remove(setting.Name)
+		if setting.Value == "" {
+			continue
+		}
+		if s.values == nil {
+			s.values = make(map[string]string)
+		}
+		s.names = append(s.names, setting.Name)
+		s.values[setting.Name] = setting.Value
+	}
+}
+
+func (s *sessionSettings) remove(name string) {
+	if _, ok := s.values[name]; !ok {
+		return
+	}
+	delete(s.values, name)
+	for i, n := range s.names {
+		if n == name {
+			s.names = append(s.names[:i], s.names[i+1:]...)
+			return
+		}
+	}
+}
+
+// delta returns the variables to set on a connection holding the settings
+// applied, in order. If it holds settings the client no longer has, its
+// settings must be reset first and all variables are returned.
+func (s *sessionSettings) delta(applied map[string]string) (names []string, reset bool) {
+	for name := range applied {
+		if _, ok := s.values[name]; !ok {
+			return s.names, true
+		}
+	}
+	for _, name := range s.names {
+		if applied[name] != s.values[name] {
+			names = append(names, name)
+		}
+	}
+	return names, false
+}
+
+// applied returns the settings of a connection holding applied once the
+// variables names were set on it.
+func (s *sessionSettings) applied(applied map[string]string, names []string) map[string]string {
+	if applied == nil {
+		applied = make(map[string]string)
+	}
+	for _, name := range names {
+		applied[name] = s.values[name]
+	}
+	return applied
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"reflect"
+	"testing"
+)
+
+func TestSessionSettingsDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings []classifier.Setting
+		applied  map[string]string
+		names    []string
+		reset    bool
+	}{
+		{name: "none"},
+		{name: "new connection",
+			settings: []classifier.Setting{{Name: "time_zone", Value: "'+00:00'"}, {Name: "sql_mode", Value: "'ANSI'"}},
+			names:    []string{"time_zone", "sql_mode"}},
+		{name: "up to date",
+			settings: []classifier.Setting{{Name: "time_zone", Value: "'+00:00'"}},
+			applied:  map[string]string{"time_zone": "'+00:00'"}},
+		{name: "changed value",
+			settings: []classifier.Setting{{Name: "time_zone", Value: "'+00:00'"}, {Name: "sql_mode", Value: "'ANSI'"}},
+			applied:  map[string]string{"time_zone": "'+01:00'", "sql_mode": "'ANSI'"},
+			names:    []string{"time_zone"}},
+		{name: "set again, in the order last set",
+			settings: []classifier.Setting{{Name: "names", Value: "utf8mb4"}, {Name: "character set", Value: "latin1"},
+				{Name: "names", Value: "utf8"}},
+			names: []string{"character set", "names"}},
+		{name: "reset to default",
+			settings: []classifier.Setting{{Name: "time_zone", Value: "'+00:00'"}, {Name: "sql_mode", Value: "'ANSI'"},
+				{Name: "time_zone"}},
+			applied: map[string]string{"time_zone": "'+00:00'", "sql_mode": "'ANSI'"},
+			names:   []string{"sql_mode"}, reset: true},
+		{name: "all reset",
+			settings: []classifier.Setting{{Name: "time_zone", Value: "'+00:00'"}, {}},
+			applied:  map[string]string{"time_zone": "'+00:00'"},
+			reset:    true},
+		{name: "set on the connection only",
+			applied: map[string]string{"time_zone": "'+00:00'"},
+			reset:   true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s sessionSettings
+			s.update(tt.settings)
+			names, reset := s.delta(tt.applied)
+			if len(names) == 0 {
+				names = nil
+			}
+			if !reflect.DeepEqual(names, tt.names) || reset != tt.reset {
+				t.Errorf("delta() = %q, %v, want %q, %v", names, reset, tt.names, tt.reset)
+			}
+			applied := s.applied(nil, names)
+			if !reset {
+				for name, value := range tt.applied {
+					if _, ok := applied[name]; !ok {
+						applied[name] = value
+					}
+				}
+			}
+			if names, reset := s.delta(applied); len(names) != 0 || reset {
+				t.Errorf("delta() after applying = %q, %v, want none", names, reset)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"log"
+)
+
+// sessionState tracks the session-scoped state a session created on the
+// main server, such as temporary tables or table locks. While it holds
+// any, all of its statements stay on the main server.
+type sessionState struct {
+	// session identifies the session in the log.
+	session string
+	held    []classifier.StateChange
+}
+
+func newSessionState(session string) sessionState {
+	return sessionState{session: session}
+}
+
+// update records the state changes of a statement run on the main server.
+func (s *sessionState) update(changes []classifier.StateChange) {
+	pinned := len(s.held) > 0
+	for _, change := range changes {
+		if !change.Release {
+			if !s.holds(change) {
+				s.held = append(s.held, change)
+			}
+			continue
+		}
+		held := s.held[:0]
+		for _, h := range s.held {
+			if change.Kind != "" && (h.Kind != change.Kind || change.Name != "" && h.Name != change.Name) {
+				held = append(held, h)
+			}
+		}
+		s.held = held
+	}
+	switch {
+	case !pinned && len(s.held) > 0:
+		log.Println("Pin session", s.session, "to main: holds", s.held[0])
+	case pinned && len(s.held) == 0:
+		log.Println("Unpin session", s.session, "from main: state released")
+	}
+}
+
+func (s *sessionState) holds(change classifier.StateChange) bool {
+	for _, h := range s.held {
+		if h == change {
+			return true
+		}
+	}
+	return false
+}
+
+// reason returns the state pinning the session to the main server, or ""
+// if it holds none.
+func (s *sessionState) reason() string {
+	if len(s.held) == 0 {
+		return ""
+	}
+	return "session holds " + s.held[0].String()
+}
+
+// reset forgets all state, as the session was reset on the server.
+func (s *sessionState) reset() {
+	s.update([]classifier.StateChange{{Release: true}})
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"dbrwproxy/classifier"
+	"testing"
+)
+
+func TestSessionState(t *testing.T) {
+	tmp := classifier.StateChange{Kind: classifier.TemporaryTable, Name: "tmp"}
+	other := classifier.StateChange{Kind: classifier.TemporaryTable, Name: "other"}
+	locks := classifier.StateChange{Kind: classifier.TableLocks}
+	release := func(change classifier.StateChange) classifier.StateChange {
+		change.Release = true
+		return change
+	}
+	tests := []struct {
+		name    string
+		changes []classifier.StateChange
+		reason  string
+	}{
+		{name: "none"},
+		{name: "held", changes: []classifier.StateChange{tmp}, reason: "session holds temporary table tmp"},
+		{name: "held twice, released once", changes: []classifier.StateChange{tmp, tmp, release(tmp)}},
+		{name: "other released", changes: []classifier.StateChange{tmp, release(other)}, reason: "session holds temporary table tmp"},
+		{name: "kind released", changes: []classifier.StateChange{tmp, other, locks, {Kind: classifier.TemporaryTable, Release: true}},
+			reason: "session holds table locks"},
+		{name: "all released", changes: []classifier.StateChange{tmp, locks, {Release: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSessionState("test")
+			s.update(tt.changes)
+			if got := s.reason(); got != tt.reason {
+				t.Errorf("reason() = %q, want %q", got, tt.reason)
+			}
+		})
+	}
+}
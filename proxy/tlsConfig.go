@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dbrwproxy/config"
+	"dbrwproxy/postgres"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// listenerTLS is how the proxy secures the connections of clients. config
+// is nil if it does not terminate TLS itself.
+type listenerTLS struct {
+	config *tls.Config
+	// certRequired rejects clients without a verified certificate,
+	// certUser those whose certificate is not issued to the user they log
+	// in as.
+	certRequired, certUser bool
+}
+
+// serverTLS loads the certificate the proxy presents to clients asking for
+// TLS, and how it verifies theirs.
+func serverTLS(conf config.ServerConfig) (listenerTLS, error) {
+	if conf.TLSCert == "" && conf.TLSKey == "" {
+		if conf.TLSClientAuth != "" && conf.TLSClientAuth != "none" {
+			return listenerTLS{}, errors.New("client certificates need a certificate of the proxy")
+		}
+		return listenerTLS{}, nil
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return listenerTLS{}, err
+	}
+	l := listenerTLS{config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	switch conf.TLSClientAuth {
+	case "", "none":
+		return l, nil
+	case "optional":
+		l.config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "verify-ca":
+		l.config.ClientAuth = tls.RequireAndVerifyClientCert
+		l.certRequired = true
+	case "verify-full":
+		l.config.ClientAuth = tls.RequireAndVerifyClientCert
+		l.certRequired, l.certUser = true, true
+	default:
+		return listenerTLS{}, fmt.Errorf("unknown client authentication %s", conf.TLSClientAuth)
+	}
+	if conf.TLSClientCA == "" {
+		return listenerTLS{}, errors.New("client certificates need a CA")
+	}
+	if l.config.ClientCAs, err = certPool(conf.TLSClientCA); err != nil {
+		return listenerTLS{}, err
+	}
+	return l, nil
+}
+
+// certPool reads the certificates of a PEM file.
+func certPool(name string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", name)
+	}
+	return pool, nil
+}
+
+// check verifies that a client logging in as user over conn presented the
+// certificate required.
+func (l listenerTLS) check(conn net.Conn, user string) error {
+	if !l.certRequired {
+		return nil
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+		return errors.New("connection requires a valid client certificate")
+	}
+	if l.certUser && tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName != user {
+		return fmt.Errorf("certificate authentication failed for user %q", user)
+	}
+	return nil
+}
+
+// backendTLS is how the proxy connects to a database server. config is
+// nil for plain connections, required false if plain connections are
+// acceptable when the server does not support TLS.
+type backendTLS struct {
+	config   *tls.Config
+	required bool
+}
+
+// newBackendTLS reads a TLS mode of the configuration for the server at
+// addr, with the certificates of conn. The default is false, only the
+// modes skip-verify and preferred skip verifying the server.
+func newBackendTLS(mode, addr string, conn config.Connection) (backendTLS, error) {
+	var b backendTLS
+	switch mode {
+	case "preferred":
+		b = backendTLS{config: &tls.Config{InsecureSkipVerify: true}}
+	case "skip-verify":
+		b = backendTLS{config: &tls.Config{InsecureSkipVerify: true}, required: true}
+	case "true":
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return backendTLS{}, err
+		}
+		b = backendTLS{config: &tls.Config{ServerName: host}, required: true}
+		if conn.TLSCA != "" {
+			if b.config.RootCAs, err = certPool(conn.TLSCA); err != nil {
+				return backendTLS{}, err
+			}
+		}
+	case "", "false":
+	default:
+		return backendTLS{}, fmt.Errorf("unknown TLS mode %s", mode)
+	}
+	return b, b.loadCertificate(conn)
+}
+
+// newPostgresBackendTLS reads a libpq sslmode of the configuration for the
+// server at addr, with the certificates of conn. The default is disable.
+func newPostgresBackendTLS(mode, addr string, conn config.Connection) (backendTLS, error) {
+	if mode == "" {
+		mode = "disable"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return backendTLS{}, err
+	}
+	config, required, err := postgres.SSLModeConfig(mode, host, conn.TLSCA)
+	if err != nil {
+		return backendTLS{}, err
+	}
+	b := backendTLS{config: config, required: required}
+	return b, b.loadCertificate(conn)
+}
+
+// loadCertificate adds the client certificate of conn to the
+// configuration.
+func (b backendTLS) loadCertificate(conn config.Connection) error {
+	if b.config == nil {
+		if conn.TLSCA != "" || conn.TLSCert != "" || conn.TLSKey != "" {
+			return errors.New("TLS certificates given for plain connections")
+		}
+		return nil
+	}
+	if conn.TLSCert == "" && conn.TLSKey == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(conn.TLSCert, conn.TLSKey)
+	if err != nil {
+		return err
+	}
+	b.config.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// bufferedConn is a connection read through a reader that may hold bytes
+// already received, for a TLS handshake following messages read off it.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
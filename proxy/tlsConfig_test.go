@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dbrwproxy/config"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for localhost and its
+// key to PEM files in dir, returning their names.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, keyFile
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir)
+	tests := []struct {
+		name string
+		conf config.ServerConfig
+		err  bool
+		// the listener expected, with or without a configuration
+		terminates             bool
+		clientAuth             tls.ClientAuthType
+		certRequired, certUser bool
+	}{
+		{name: "no certificate"},
+		{name: "client certificates without certificate", conf: config.ServerConfig{TLSClientAuth: "optional"}, err: true},
+		{name: "certificate", conf: config.ServerConfig{TLSCert: cert, TLSKey: key}, terminates: true},
+		{name: "missing key", conf: config.ServerConfig{TLSCert: cert}, err: true},
+		{name: "missing file", conf: config.ServerConfig{TLSCert: cert, TLSKey: filepath.Join(dir, "missing.pem")}, err: true},
+		{name: "optional", conf: config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "optional", TLSClientCA: cert},
+			terminates: true, clientAuth: tls.VerifyClientCertIfGiven},
+		{name: "verify-ca", conf: config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "verify-ca", TLSClientCA: cert},
+			terminates: true, clientAuth: tls.RequireAndVerifyClientCert, certRequired: true},
+		{name: "verify-full", conf: config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "verify-full", TLSClientCA: cert},
+			terminates: true, clientAuth: tls.RequireAndVerifyClientCert, certRequired: true, certUser: true},
+		{name: "client certificates without CA", conf: config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "verify-ca"}, err: true},
+		{name: "CA without certificates", conf: config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "verify-ca", TLSClientCA: key}, err: true},
+		{name: "unknown client authentication", conf: config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "require"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := serverTLS(tt.conf)
+			if (err != nil) != tt.err {
+				t.Fatalf("serverTLS: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if (l.config != nil) != tt.terminates {
+				t.Fatalf("configuration %v, want one %v", l.config, tt.terminates)
+			}
+			if l.config != nil && l.config.ClientAuth != tt.clientAuth {
+				t.Errorf("client authentication %v, want %v", l.config.ClientAuth, tt.clientAuth)
+			}
+			if l.certRequired != tt.certRequired || l.certUser != tt.certUser {
+				t.Errorf("certificate required %v for the user %v, want %v for the user %v",
+					l.certRequired, l.certUser, tt.certRequired, tt.certUser)
+			}
+		})
+	}
+}
+
+func TestListenerTLSCheck(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir)
+	l, err := serverTLS(config.ServerConfig{TLSCert: cert, TLSKey: key, TLSClientAuth: "verify-full", TLSClientCA: cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := net.Pipe()
+	if err = l.check(plain, "localhost"); err == nil {
+		t.Error("plain connection accepted")
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := certPool(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, local := net.Pipe()
+	defer client.Close()
+	defer local.Close()
+	go tls.Client(client, &tls.Config{
+		ServerName:   "localhost",
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}).Handshake()
+	conn := tls.Server(local, l.config)
+	if err = conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.check(conn, "localhost"); err != nil {
+		t.Errorf("certificate of the user rejected: %v", err)
+	}
+	if err = l.check(conn, "app"); err == nil {
+		t.Error("certificate of another user accepted")
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCertificate(t, dir)
+	withCA := config.Connection{TLSCA: cert}
+	withCert := config.Connection{TLSCert: cert, TLSKey: key}
+
+	// verify is how the certificate of the server is checked: not at all,
+	// against the host name, or only its chain
+	const (
+		none = iota
+		host
+		chain
+	)
+	tests := []struct {
+		name     string
+		postgres bool
+		mode     string
+		conn     config.Connection
+		err      bool
+		// the TLS expected, plain without encrypt
+		encrypt, required bool
+		verify            int
+	}{
+		{name: "MySQL default"},
+		{name: "MySQL false", mode: "false"},
+		{name: "MySQL preferred", mode: "preferred", encrypt: true},
+		{name: "MySQL skip-verify", mode: "skip-verify", encrypt: true, required: true},
+		{name: "MySQL true", mode: "true", encrypt: true, required: true, verify: host},
+		{name: "MySQL true with CA", mode: "true", conn: withCA, encrypt: true, required: true, verify: host},
+		{name: "MySQL client certificate", mode: "true", conn: withCert, encrypt: true, required: true, verify: host},
+		{name: "MySQL certificate without TLS", conn: withCert, err: true},
+		{name: "MySQL unknown mode", mode: "required", err: true},
+		{name: "PostgreSQL default", postgres: true},
+		{name: "PostgreSQL disable", postgres: true, mode: "disable"},
+		{name: "PostgreSQL allow", postgres: true, mode: "allow", encrypt: true},
+		{name: "PostgreSQL prefer", postgres: true, mode: "prefer", encrypt: true},
+		{name: "PostgreSQL require", postgres: true, mode: "require", encrypt: true, required: true},
+		{name: "PostgreSQL require with CA", postgres: true, mode: "require", conn: withCA, encrypt: true, required: true, verify: chain},
+		{name: "PostgreSQL verify-ca", postgres: true, mode: "verify-ca", conn: withCA, encrypt: true, required: true, verify: chain},
+		{name: "PostgreSQL verify-full", postgres: true, mode: "verify-full", encrypt: true, required: true, verify: host},
+		{name: "PostgreSQL CA without certificates", postgres: true, mode: "verify-ca", conn: config.Connection{TLSCA: key}, err: true},
+		{name: "PostgreSQL certificate without TLS", postgres: true, conn: withCert, err: true},
+		{name: "PostgreSQL unknown mode", postgres: true, mode: "true", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b backendTLS
+			var err error
+			if tt.postgres {
+				b, err = newPostgresBackendTLS(tt.mode, "db.example.com:5432", tt.conn)
+			} else {
+				b, err = newBackendTLS(tt.mode, "db.example.com:3306", tt.conn)
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("backend TLS: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if (b.config != nil) != tt.encrypt || b.required != tt.required {
+				t.Fatalf("TLS %v required %v, want %v required %v", b.config != nil, b.required, tt.encrypt, tt.required)
+			}
+			if b.config == nil {
+				return
+			}
+			verify := none
+			switch {
+			case !b.config.InsecureSkipVerify:
+				verify = host
+				if b.config.ServerName != "db.example.com" {
+					t.Errorf("server name %q", b.config.ServerName)
+				}
+			case b.config.VerifyConnection != nil:
+				verify = chain
+			}
+			if verify != tt.verify {
+				t.Errorf("verification %d, want %d", verify, tt.verify)
+			}
+			if tt.conn.TLSCA != "" && b.config.RootCAs == nil && verify == host {
+				t.Error("CA not loaded")
+			}
+			if (tt.conn.TLSCert != "") != (len(b.config.Certificates) == 1) {
+				t.Errorf("client certificates %d", len(b.config.Certificates))
+			}
+		})
+	}
+}
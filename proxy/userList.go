@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"dbrwproxy/config"
+	"fmt"
+)
+
+// Methods clients may authenticate to the proxy with, the default first.
+var (
+	mysqlAuthMethods    = []string{"caching_sha2_password", "mysql_native_password"}
+	postgresAuthMethods = []string{"scram-sha-256", "md5"}
+)
+
+// userList holds the users a proxy authenticates clients against itself,
+// and the method they prove their password with.
+type userList struct {
+	method string
+	users  map[string]config.User
+}
+
+// newUserList reads the user file of conf. It returns nil if there is
+// none, clients then authenticate with the main database.
+func newUserList(conf config.Proxy, methods []string) (*userList, error) {
+	if conf.UserFile == "" {
+		if conf.AuthMethod != "" {
+			return nil, fmt.Errorf("AuthMethod %s without UserFile", conf.AuthMethod)
+		}
+		return nil, nil
+	}
+	method := conf.AuthMethod
+	if method == "" {
+		method = methods[0]
+	}
+	known := false
+	for _, m := range methods {
+		known = known || m == method
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown AuthMethod %s", method)
+	}
+	users, err := config.ReadUsers(conf.UserFile)
+	if err != nil {
+		return nil, err
+	}
+	return &userList{method: method, users: users}, nil
+}
+
+// mainCredentials returns the credentials the sessions of user log in to
+// the main database with.
+func mainCredentials(user config.User) config.Credentials {
+	if user.Main.User == "" {
+		return config.Credentials{User: user.Name, Password: user.Password}
+	}
+	return user.Main
+}
+
+// secondaryCredentials returns the credentials the reads of user run with
+// on the secondaries.
+func secondaryCredentials(user config.User) *config.Credentials {
+	if user.Secondary.User == "" {
+		return &config.Credentials{User: user.Name, Password: user.Password}
+	}
+	return &user.Secondary
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"dbrwproxy/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewUserList(t *testing.T) {
+	dir := t.TempDir()
+	file := func(content string) string {
+		f, err := os.CreateTemp(dir, "users*.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err = f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	users := file("Users:\n  - Name: app\n    Password: secret\n  - Name: report\n    Password: other\n")
+
+	tests := []struct {
+		name     string
+		file     string
+		method   string
+		err      bool
+		want     string
+		wantUser string
+	}{
+		{name: "no user file"},
+		{name: "method without user file", method: "md5", err: true},
+		{name: "default method", file: users, want: "scram-sha-256", wantUser: "app"},
+		{name: "method", file: users, method: "md5", want: "md5", wantUser: "report"},
+		{name: "unknown method", file: users, method: "password", err: true},
+		{name: "missing file", file: filepath.Join(dir, "missing.yml"), err: true},
+		{name: "invalid YAML", file: file("Users: [\n"), err: true},
+		{name: "user without name", file: file("Users:\n  - Password: secret\n"), err: true},
+		{name: "duplicate user", file: file("Users:\n  - Name: app\n  - Name: app\n"), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := newUserList(config.Proxy{UserFile: tt.file, AuthMethod: tt.method}, postgresAuthMethods)
+			if (err != nil) != tt.err {
+				t.Fatalf("newUserList: %v", err)
+			}
+			switch {
+			case err != nil:
+			case tt.want == "" && list != nil:
+				t.Errorf("user list %+v without a user file", list)
+			case tt.want != "" && (list == nil || list.method != tt.want):
+				t.Errorf("user list %+v, want method %s", list, tt.want)
+			case tt.wantUser != "" && list.users[tt.wantUser].Name != tt.wantUser:
+				t.Errorf("user %s missing from %+v", tt.wantUser, list.users)
+			}
+		})
+	}
+}
+
+func TestUserCredentials(t *testing.T) {
+	plain := config.User{Name: "app", Password: "secret"}
+	mapped := config.User{
+		Name:      "app",
+		Password:  "secret",
+		Main:      config.Credentials{User: "app_rw", Password: "rw"},
+		Secondary: config.Credentials{User: "app_ro", Password: "ro"},
+	}
+	if got := mainCredentials(plain); got != (config.Credentials{User: "app", Password: "secret"}) {
+		t.Errorf("main credentials %+v of a user without mapping", got)
+	}
+	if got := *secondaryCredentials(plain); got != (config.Credentials{User: "app", Password: "secret"}) {
+		t.Errorf("secondary credentials %+v of a user without mapping", got)
+	}
+	if got := mainCredentials(mapped); got != mapped.Main {
+		t.Errorf("main credentials %+v, want %+v", got, mapped.Main)
+	}
+	if got := *secondaryCredentials(mapped); got != mapped.Secondary {
+		t.Errorf("secondary credentials %+v, want %+v", got, mapped.Secondary)
+	}
+}